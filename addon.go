@@ -0,0 +1,367 @@
+// addon.go
+// Loads the addon_config.yml of each --addons directory and resolves the
+// addons that they require, so invalid combinations of addons are rejected
+// before any image is built.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AddonConfigName is the file in each addon directory that describes the addon
+const AddonConfigName = "addon_config.yml"
+
+// The build arguments that are given to every image build by container.GetBuildArgs
+var providedBuildArgs = []string{"BASE", "PLATFORM", "PACKAGE_MANAGER", "PLAYBOOK_SRV", "SAS_RPM_REPO_URL"}
+
+// Addon is an addon directory and the content of its addon_config.yml.
+//
+// The original addon_config.yml format only maps each image name to its Dockerfiles,
+// such as "programming: {dockerfiles: [Dockerfile]}". The current format places that
+// map under "images" and also describes the addon. Both formats are accepted.
+type Addon struct {
+	Name            string                   `yaml:"-"`
+	Path            string                   `yaml:"-"` // The addon directory with a trailing slash
+	Version         string                   `yaml:"version"`
+	Description     string                   `yaml:"description"`
+	DeploymentTypes []string                 `yaml:"deployment_types"` // Default: every deployment type
+	Requires        []string                 `yaml:"requires"`         // Addons that are added before this addon
+	Conflicts       []string                 `yaml:"conflicts"`        // Addons that cannot be used with this addon
+	BuildArgs       []string                 `yaml:"build_args"`       // Build arguments that the Dockerfiles need the build to provide
+	Files           []string                 `yaml:"files"`            // Files or patterns that must be placed in the addon directory before building
+	Images          map[string]effectedImage `yaml:"images"`
+	LintIgnore      []string                 `yaml:"lint_ignore"` // The lint rules that are not checked for the Dockerfile lines of this addon
+
+	// The default of an ARG in the Dockerfiles for each deployment type, such as
+	// "BASEIMAGE: {single: viya-single-container, default: non-single-container}".
+	// The "default" value is used for the deployment types that are not listed.
+	DeploymentArgs map[string]map[string]string `yaml:"deployment_args"`
+
+	// What the addon adds to the generated manifests of each container
+	Manifests map[string]AddonManifest `yaml:"manifests"`
+
+	// Files from a vendor, such as client packages, that are placed in the addon directory or the artifact cache
+	Artifacts []AddonArtifact `yaml:"artifacts"`
+
+	// The artifacts that are found in the artifact cache, as their path in the Docker context and their cached file
+	CachedArtifacts map[string]string `yaml:"-"`
+
+	// The .tar.gz package that the addon was unpacked from, if it was given as a package
+	Package string `yaml:"-"`
+}
+
+// AddonArtifact is a file from a vendor that an addon needs, such as the Oracle Instant Client RPMs.
+// An artifact is found in the addon directory or in the <addon> directory of the --artifact-cache.
+type AddonArtifact struct {
+	Path   string `yaml:"path"`   // A file, directory, or pattern such as "*.rpm" that is relative to the addon directory
+	SHA256 string `yaml:"sha256"` // The checksum of the file, which is checked before any image is built
+	Source string `yaml:"source"` // Where to obtain the artifact
+}
+
+// AddonManifest is the runtime config that an addon needs in a container's deployment.
+// The items use the same "<name>=<value>" form as the config-<deployment-type>.yml file and are
+// merged into the container's config before any --config file, so a --config file can still change them.
+// Each "<name>=<path>" volume is an empty directory that is mounted at the path, and each file
+// is mounted from a ConfigMap or a Secret with its source relative to the addon directory.
+type AddonManifest struct {
+	Environment []string        `yaml:"environment"`
+	Secrets     []string        `yaml:"secrets"`
+	Volumes     []string        `yaml:"volumes"`
+	Files       []ContainerFile `yaml:"files"`
+}
+
+// overlay returns the manifest items as a --config overlay of the container
+func (manifest AddonManifest) overlay() ConfigOverlay {
+	overlay := ConfigOverlay{}
+	overlay.Environment = manifest.Environment
+	overlay.Secrets = manifest.Secrets
+	overlay.Volumes = manifest.Volumes
+	overlay.Files = manifest.Files
+	return overlay
+}
+
+// deploymentArg returns the value of an ARG for a deployment type, if the addon sets one
+func (addon *Addon) deploymentArg(name string, deploymentType string) (string, bool) {
+	values, found := addon.DeploymentArgs[name]
+	if !found {
+		return "", false
+	}
+	if value, found := values[deploymentType]; found {
+		return value, true
+	}
+	value, found := values["default"]
+	return value, found
+}
+
+// ApplyDeploymentArgs returns an ARG instruction with the defaults that the addon sets for the deployment type.
+// The other arguments of the ARG, and any other instruction, are kept as they are written.
+func (addon *Addon) ApplyDeploymentArgs(instruction DockerfileInstruction, deploymentType string) string {
+	if instruction.Command != "ARG" || len(addon.DeploymentArgs) == 0 {
+		return instruction.Original
+	}
+	changed := false
+	args := splitDockerfileWords(instruction.Value)
+	for index, arg := range args {
+		name := strings.SplitN(arg, "=", 2)[0]
+		if value, found := addon.deploymentArg(name, deploymentType); found {
+			// A value with spaces or quotes is quoted so it stays a single word
+			if strings.ContainsAny(value, " \t\"'\\") {
+				value = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+			}
+			args[index] = name + "=" + value
+			changed = true
+		}
+	}
+	if !changed {
+		return instruction.Original
+	}
+	return "ARG " + strings.Join(args, " ")
+}
+
+// isAddonConfigV2 reports if an addon_config.yml uses the current format
+func isAddonConfigV2(content []byte) bool {
+	probe := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &probe); err != nil {
+		return false
+	}
+	_, found := probe["images"]
+	return found
+}
+
+// LoadAddon reads the addon_config.yml of an addon directory
+func LoadAddon(path string) (*Addon, error) {
+	path = strings.TrimSuffix(path, "/") + "/"
+	addon := &Addon{
+		Name:   filepath.Base(path),
+		Path:   path,
+		Images: make(map[string]effectedImage),
+	}
+	content, err := ioutil.ReadFile(path + AddonConfigName)
+	if err != nil {
+		return addon, err
+	}
+	if isAddonConfigV2(content) {
+		err = yaml.UnmarshalStrict(content, addon)
+	} else {
+		err = yaml.Unmarshal(content, &addon.Images)
+	}
+	if err != nil {
+		return addon, fmt.Errorf("Unable to parse %s%s, %s", path, AddonConfigName, err.Error())
+	}
+	return addon, nil
+}
+
+// sha256File returns the hex encoded SHA-256 checksum of a file
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ResolveArtifacts finds each artifact of the addon in the addon directory or the artifact cache and checks its checksum.
+// The artifacts that are found in the cache are kept in addon.CachedArtifacts. Every problem is returned.
+func (addon *Addon) ResolveArtifacts(cache string) []string {
+	problems := []string{}
+	addon.CachedArtifacts = make(map[string]string)
+	cachePath := ""
+	if len(cache) > 0 {
+		cachePath = strings.TrimSuffix(cache, "/") + "/" + addon.Name + "/"
+	}
+
+	for _, artifact := range addon.Artifacts {
+		matches, _ := filepath.Glob(addon.Path + artifact.Path)
+		fromCache := false
+		if len(matches) == 0 && len(cachePath) > 0 {
+			matches, _ = filepath.Glob(cachePath + artifact.Path)
+			fromCache = true
+		}
+		if len(matches) == 0 {
+			locations := addon.Path
+			if len(cachePath) > 0 {
+				locations += " or " + cachePath
+			}
+			problem := fmt.Sprintf("Addon %s requires the artifact %s in %s", addon.Name, artifact.Path, locations)
+			if len(artifact.Source) > 0 {
+				problem += ": obtain it from " + artifact.Source
+			}
+			problems = append(problems, problem)
+			continue
+		}
+
+		if len(artifact.SHA256) > 0 {
+			checksum, err := sha256File(matches[0])
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Unable to check the artifact %s of the addon %s, %s", matches[0], addon.Name, err.Error()))
+			} else if !strings.EqualFold(checksum, artifact.SHA256) {
+				problems = append(problems, fmt.Sprintf("The artifact %s of the addon %s has the SHA-256 checksum %s instead of %s",
+					matches[0], addon.Name, checksum, artifact.SHA256))
+			}
+		}
+
+		// Each file of a cached directory is added to the Docker context as if it were in the addon directory
+		if fromCache {
+			for _, match := range matches {
+				_ = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+					if info != nil && !info.IsDir() {
+						addon.CachedArtifacts[strings.TrimPrefix(path, cachePath)] = path
+					}
+					return nil
+				})
+			}
+		}
+	}
+	return problems
+}
+
+// findAddon returns the directory of an addon that is given as a path or as a name in the addons directory
+func findAddon(name string) (string, error) {
+	if _, err := os.Stat(name); err == nil {
+		return strings.TrimSuffix(name, "/") + "/", nil
+	}
+	if _, err := os.Stat("addons/" + name); err == nil {
+		return "addons/" + strings.TrimSuffix(name, "/") + "/", nil
+	}
+	return "", fmt.Errorf("Addon %s could not be found", name)
+}
+
+// ResolveAddons loads the addons and the addons they require, ordered so each addon comes after
+// the addons it requires. Every problem with the combination is returned as a single error.
+func ResolveAddons(names []string, deploymentType string, deploymentTypes map[string]DeploymentDefinition, buildArgs []string) ([]*Addon, error) {
+	resolved := []*Addon{}
+	visiting := make(map[string]bool)
+	added := make(map[string]bool)
+
+	var visit func(name string, requiredBy string) error
+	visit = func(name string, requiredBy string) error {
+		path, err := findAddon(name)
+		if err != nil {
+			if len(requiredBy) > 0 {
+				return fmt.Errorf("Addon %s requires the addon %s, which could not be found", requiredBy, name)
+			}
+			return err
+		}
+		addon, err := LoadAddon(path)
+		if err != nil {
+			return err
+		}
+		if added[addon.Name] {
+			return nil
+		}
+		if visiting[addon.Name] {
+			return fmt.Errorf("Addon %s has a circular requirement on the addon %s", requiredBy, addon.Name)
+		}
+		visiting[addon.Name] = true
+		for _, required := range addon.Requires {
+			if err := visit(required, addon.Name); err != nil {
+				return err
+			}
+		}
+		added[addon.Name] = true
+		resolved = append(resolved, addon)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	problems := []string{}
+	for _, addon := range resolved {
+		if len(addon.DeploymentTypes) > 0 && !stringInSlice(deploymentType, addon.DeploymentTypes) {
+			problems = append(problems, fmt.Sprintf("Addon %s does not support the %s deployment type: choose between %s",
+				addon.Name, deploymentType, strings.Join(addon.DeploymentTypes, ", ")))
+		}
+		for arg, values := range addon.DeploymentArgs {
+			for name := range values {
+				if _, found := deploymentTypes[name]; !found && name != "default" {
+					problems = append(problems, fmt.Sprintf("Addon %s sets %s for the unknown deployment type %s: choose between default, %s",
+						addon.Name, arg, name, deploymentTypeNames(deploymentTypes)))
+				}
+			}
+		}
+		for _, conflict := range addon.Conflicts {
+			if added[conflict] {
+				problems = append(problems, fmt.Sprintf("Addon %s cannot be used with the addon %s", addon.Name, conflict))
+			}
+		}
+		for _, buildArg := range addon.BuildArgs {
+			if !stringInSlice(buildArg, buildArgs) {
+				problems = append(problems, fmt.Sprintf("Addon %s requires the build argument %s, which is not provided: choose between %s",
+					addon.Name, buildArg, strings.Join(buildArgs, ", ")))
+			}
+		}
+		for _, pattern := range addon.Files {
+			if matches, _ := filepath.Glob(addon.Path + pattern); len(matches) == 0 {
+				problems = append(problems, fmt.Sprintf("Addon %s requires %s in %s", addon.Name, pattern, addon.Path))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "\n"))
+	}
+	return resolved, nil
+}
+
+// AddonSummary describes each addon of the order for the build summary
+func (order *SoftwareOrder) AddonSummary() string {
+	if len(order.AddonConfigs) == 0 {
+		return ""
+	}
+	lines := []string{"Addons:"}
+	for _, addon := range order.AddonConfigs {
+		name := addon.Name
+		if len(addon.Version) > 0 {
+			name += " " + addon.Version
+		}
+		images := []string{}
+		for image := range addon.Images {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+		description := addon.Description
+		if len(description) == 0 {
+			description = "No description"
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s", name, description))
+		lines = append(lines, fmt.Sprintf("      Images: %s", strings.Join(images, ", ")))
+		if len(addon.Package) > 0 {
+			lines = append(lines, fmt.Sprintf("      Package: %s", addon.Package))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,127 @@
+// addon_test.go
+// Tests the instructions that the addons add to the images.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Only the ARG that the addon sets for the deployment type is rewritten, and quoted defaults stay whole
+func TestApplyDeploymentArgs(t *testing.T) {
+	addon := &Addon{DeploymentArgs: map[string]map[string]string{
+		"MODE":  {"full": "mpp", "default": "smp"},
+		"FLAGS": {"full": "-x -y"},
+	}}
+	tests := map[string]struct {
+		instruction    string
+		deploymentType string
+		expected       string
+	}{
+		"deployment type": {`ARG MODE=none`, "full", `ARG MODE=mpp`},
+		"default":         {`ARG MODE=none`, "multiple", `ARG MODE=smp`},
+		"quoted default":  {`ARG OPTS="-a -b" MODE=none`, "full", `ARG OPTS="-a -b" MODE=mpp`},
+		"quoted value":    {`ARG FLAGS`, "full", `ARG FLAGS="-x -y"`},
+		"not set":         {`ARG OPTS="-a -b"`, "full", `ARG OPTS="-a -b"`},
+		"no value":        {`ARG FLAGS="-a"`, "multiple", `ARG FLAGS="-a"`},
+		"not an ARG":      {`ENV MODE=none`, "full", `ENV MODE=none`},
+	}
+	for name, test := range tests {
+		dockerfile, err := ParseDockerfile("FROM centos:7\n" + test.instruction + "\n")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if result := addon.ApplyDeploymentArgs(dockerfile.Instructions[1], test.deploymentType); result != test.expected {
+			t.Errorf("%s: expected %s, got %s", name, test.expected, result)
+		}
+	}
+}
+
+// ResolveAddons orders each addon after the addons it requires and reports every problem of the combination
+func TestResolveAddons(t *testing.T) {
+	directory, err := ioutil.TempDir("", "addons")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(directory)
+
+	configs := map[string]string{
+		"base":        "version: 1.0.0\nimages: {}\n",
+		"access-a":    "version: 1.0.0\nrequires: [" + directory + "/base]\nimages: {}\n",
+		"access-b":    "version: 1.0.0\nrequires: [" + directory + "/base]\nconflicts: [access-a]\nimages: {}\n",
+		"loop-a":      "version: 1.0.0\nrequires: [" + directory + "/loop-b]\nimages: {}\n",
+		"loop-b":      "version: 1.0.0\nrequires: [" + directory + "/loop-a]\nimages: {}\n",
+		"missing":     "version: 1.0.0\nrequires: [" + directory + "/unknown]\nimages: {}\n",
+		"full-only":   "version: 1.0.0\ndeployment_types: [full]\nimages: {}\n",
+		"build-arg":   "version: 1.0.0\nbuild_args: [MYDB_HOME]\nimages: {}\n",
+		"unknown-arg": "version: 1.0.0\ndeployment_args:\n  MODE: {huge: mpp}\nimages: {}\n",
+		"artifact":    "version: 1.0.0\nfiles: [\"*.rpm\"]\nimages: {}\n",
+	}
+	for name, config := range configs {
+		if err := os.MkdirAll(directory+"/"+name, 0755); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(directory+"/"+name+"/"+AddonConfigName, []byte(config), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	deploymentTypes := map[string]DeploymentDefinition{"single": {}, "multiple": {}, "full": {}}
+
+	tests := map[string]struct {
+		names    []string
+		expected []string // The resolved addons, or the problems of the error
+	}{
+		"requirement first":     {[]string{"access-a"}, []string{"base", "access-a"}},
+		"requirement once":      {[]string{"access-a", "base"}, []string{"base", "access-a"}},
+		"missing requirement":   {[]string{"missing"}, []string{"Addon missing requires the addon " + directory + "/unknown, which could not be found"}},
+		"circular requirement":  {[]string{"loop-a"}, []string{"circular requirement"}},
+		"conflict":              {[]string{"access-a", "access-b"}, []string{"Addon access-b cannot be used with the addon access-a"}},
+		"deployment type":       {[]string{"full-only"}, []string{"Addon full-only does not support the multiple deployment type"}},
+		"build argument":        {[]string{"build-arg"}, []string{"Addon build-arg requires the build argument MYDB_HOME"}},
+		"unknown deployment":    {[]string{"unknown-arg"}, []string{"sets MODE for the unknown deployment type huge"}},
+		"required file":         {[]string{"artifact"}, []string{"Addon artifact requires *.rpm in"}},
+		"every problem at once": {[]string{"full-only", "build-arg"}, []string{"does not support the multiple", "requires the build argument"}},
+	}
+	for name, test := range tests {
+		paths := []string{}
+		for _, addon := range test.names {
+			paths = append(paths, directory+"/"+addon)
+		}
+		addons, err := ResolveAddons(paths, "multiple", deploymentTypes, []string{"BASE"})
+		if err != nil {
+			for _, problem := range test.expected {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("%s: expected an error with '%s', got: %s", name, problem, err.Error())
+				}
+			}
+			continue
+		}
+		resolved := []string{}
+		for _, addon := range addons {
+			resolved = append(resolved, addon.Name)
+		}
+		if !reflect.DeepEqual(resolved, test.expected) {
+			t.Errorf("%s: expected %v, got %v", name, test.expected, resolved)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+// addoncommand.go
+// The addons command lists the addons, shows what an addon adds to each
+// image, creates the files of a new addon, and packages an addon, such as
+// `addons list`, `addons inspect access-oracle --type full`,
+// `addons new access-mydb`, or `addons package access-mydb`.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The name that addon_config.yml files use for the image of a single container deployment type
+const singleContainerImage = "sas-viya-single-programming-only"
+
+// The name of a new addon, such as access-mydb
+var addonNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-]*[a-z0-9])?$`)
+
+// The addon_config.yml of a new addon. It adds the same Dockerfile to the images that the SAS/ACCESS addons modify.
+const addonConfigTemplate = `# Addon config file.
+# Describes the addon and lists the containers and the dockerfiles that update the container that is being built.
+version: 0.1.0
+description: %q
+build_args: [PLATFORM]
+# List the files, such as the client config files, that must be placed in this directory before building
+files: []
+# List the client packages from the vendor, which are found in this directory or the --artifact-cache, such as
+# - path: mydb-client-1.0.0.x86_64.rpm
+#   sha256: <the checksum of the file>
+#   source: https://downloads.mydb.com
+artifacts: []
+images:
+  computeserver:
+    dockerfiles: [Dockerfile]
+  programming:
+    dockerfiles: [Dockerfile]
+  sas-casserver-primary:
+    dockerfiles: [Dockerfile]
+  sas-viya-single-programming-only:
+    dockerfiles: [Dockerfile]
+# Add the environment, secrets, and volumes that the deployments need, such as
+# manifests:
+#   programming:
+#     environment: [MYDB_HOME=/opt/mydb]
+`
+
+// The Dockerfile of a new addon
+const addonDockerfileTemplate = `# %s
+#
+# Only the instructions after FROM are added to each image that is listed in addon_config.yml.
+# CMD, ENTRYPOINT, SHELL, STOPSIGNAL, ONBUILD, and a second FROM cannot be used.
+#
+# BUILD:
+#   docker build --file Dockerfile --build-arg BASEIMAGE=viya-single-container --build-arg BASETAG=latest . --tag svc-%s
+#
+
+ARG BASEIMAGE=viya-single-container
+ARG BASETAG=latest
+
+FROM $BASEIMAGE:$BASETAG
+
+USER root
+
+# The image sets the PLATFORM environment variable to redhat or suse
+RUN set -e; \
+    if [ "$PLATFORM" = "redhat" ]; then \
+        echo; echo "####### Install the %s client on Red Hat or CentOS"; echo; \
+    elif [ "$PLATFORM" = "suse" ]; then \
+        echo; echo "####### Install the %s client on SUSE"; echo; \
+    else \
+        echo; echo "####### [ERROR] : Unknown platform of \"$PLATFORM\" passed in"; echo; \
+        exit 1; \
+    fi
+`
+
+// RunAddonsCommand runs the addons command with the arguments that follow it
+func RunAddonsCommand(args []string) error {
+	usage := errors.New("usage: addons list | addons inspect <name> [--type <deployment-type>] | " +
+		"addons new <name> [--description <text>] | addons package <name> [--output <directory>]")
+	if len(args) == 0 {
+		return usage
+	}
+	command := args[0]
+	name := ""
+	args = args[1:]
+	if command == "inspect" || command == "new" || command == "package" {
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			return usage
+		}
+		name = args[0]
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("addons", flag.ContinueOnError)
+	deploymentType := flags.String("type", "single", "")
+	description := flags.String("description", "", "")
+	output := flags.String("output", "builds", "")
+	if err := flags.Parse(args); err != nil {
+		return usage
+	}
+
+	deploymentTypes, err := LoadDeploymentTypes(DeploymentTypesPath)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "list":
+		return listAddons(deploymentTypes)
+	case "inspect":
+		if _, found := deploymentTypes[*deploymentType]; !found {
+			return fmt.Errorf("a valid '--type' is required: choose between %s", deploymentTypeNames(deploymentTypes))
+		}
+		return inspectAddon(name, *deploymentType)
+	case "new":
+		return newAddon(name, *description)
+	case "package":
+		path, err := findAddon(name)
+		if err != nil {
+			return err
+		}
+		packagePath, err := PackageAddon(path, *output)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created the addon package %s\n", packagePath)
+		fmt.Printf("Build with `--addons \"%s\"`\n", packagePath)
+		return nil
+	}
+	return usage
+}
+
+// deploymentImages returns the image names that an addon_config.yml can use for a deployment type
+func deploymentImages(definition DeploymentDefinition) ([]string, error) {
+	if definition.SingleContainer {
+		return []string{singleContainerImage}, nil
+	}
+	content, err := ioutil.ReadFile(definition.Config)
+	if err != nil {
+		return nil, err
+	}
+	configs := make(map[string]ContainerConfig)
+	if err := yaml.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("Unable to parse the config file %s, %s", definition.Config, err.Error())
+	}
+	images := []string{}
+	for name := range configs {
+		images = append(images, name)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// listAddons shows each addon in the addons directory and the images it modifies for each deployment type
+func listAddons(deploymentTypes map[string]DeploymentDefinition) error {
+	configPaths, err := filepath.Glob("addons/*/" + AddonConfigName)
+	if err != nil {
+		return err
+	}
+	sort.Strings(configPaths)
+	typeNames := strings.Split(deploymentTypeNames(deploymentTypes), ", ")
+
+	for _, configPath := range configPaths {
+		addon, err := LoadAddon(filepath.Dir(configPath))
+		if err != nil {
+			fmt.Printf("%s: %s\n\n", filepath.Base(filepath.Dir(configPath)), err.Error())
+			continue
+		}
+		name := addon.Name
+		if len(addon.Version) > 0 {
+			name += " " + addon.Version
+		}
+		description := addon.Description
+		if len(description) == 0 {
+			description = "No description"
+		}
+		fmt.Printf("%s: %s\n", name, description)
+
+		for _, typeName := range typeNames {
+			if len(addon.DeploymentTypes) > 0 && !stringInSlice(typeName, addon.DeploymentTypes) {
+				fmt.Printf("    %s: not supported\n", typeName)
+				continue
+			}
+			images, err := deploymentImages(deploymentTypes[typeName])
+			if err != nil {
+				return err
+			}
+			modified := []string{}
+			for _, image := range images {
+				if _, found := addon.Images[image]; found {
+					modified = append(modified, image)
+				}
+			}
+			if len(modified) == 0 {
+				modified = append(modified, "none")
+			}
+			fmt.Printf("    %s: %s\n", typeName, strings.Join(modified, ", "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// inspectAddon shows the Dockerfile lines that an addon adds to each image and the files it adds to the Docker context
+func inspectAddon(name string, deploymentType string) error {
+	path := ""
+	if isAddonPackage(name) {
+		directory, err := ioutil.TempDir("", "addon-package")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(directory)
+		if path, err = UnpackAddon(name, directory); err != nil {
+			return err
+		}
+	} else {
+		found, err := findAddon(name)
+		if err != nil {
+			return err
+		}
+		path = found
+	}
+	addon, err := LoadAddon(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Addon:       %s\n", addon.Name)
+	fmt.Printf("Path:        %s\n", addon.Path)
+	fmt.Printf("Version:     %s\n", addon.Version)
+	fmt.Printf("Description: %s\n", addon.Description)
+	fmt.Printf("Requires:    %s\n", strings.Join(addon.Requires, ", "))
+	fmt.Printf("Conflicts:   %s\n", strings.Join(addon.Conflicts, ", "))
+	fmt.Printf("Build args:  %s\n", strings.Join(addon.BuildArgs, ", "))
+	fmt.Printf("Files:       %s\n", strings.Join(addon.Files, ", "))
+	for _, artifact := range addon.Artifacts {
+		fmt.Printf("Artifact:    %s", artifact.Path)
+		if len(artifact.SHA256) > 0 {
+			fmt.Printf(" (sha256 %s)", artifact.SHA256)
+		}
+		if len(artifact.Source) > 0 {
+			fmt.Printf(" from %s", artifact.Source)
+		}
+		fmt.Println()
+	}
+
+	// The same files that container.AddDirectoryToContext adds for the addon
+	contextFiles := []string{}
+	err = filepath.Walk(addon.Path, func(file string, info os.FileInfo, err error) error {
+		if info != nil && !info.IsDir() && !skipContextFile(file) {
+			contextFiles = append(contextFiles, strings.TrimPrefix(file, addon.Path))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nFiles added to the Docker context:")
+	for _, file := range contextFiles {
+		fmt.Println("    " + file)
+	}
+
+	images := []string{}
+	for image := range addon.Images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		lines, err := appendAddonLines(image, "", deploymentType, []string{addon.Path})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nDockerfile lines added to %s for the %s deployment type:\n", image, deploymentType)
+		fmt.Println(strings.TrimSpace(lines))
+	}
+
+	manifestImages := []string{}
+	for image := range addon.Manifests {
+		manifestImages = append(manifestImages, image)
+	}
+	sort.Strings(manifestImages)
+	for _, image := range manifestImages {
+		manifest := addon.Manifests[image]
+		fmt.Printf("\nAdded to the %s manifests:\n", image)
+		for _, item := range manifest.Environment {
+			fmt.Println("    environment: " + item)
+		}
+		for _, item := range manifest.Secrets {
+			key, _ := splitKeyValue(item, "=")
+			fmt.Println("    secret: " + key)
+		}
+		for _, item := range manifest.Volumes {
+			fmt.Println("    volume: " + item)
+		}
+	}
+	return nil
+}
+
+// newAddon creates the addon_config.yml and Dockerfile of a new addon in the addons directory
+func newAddon(name string, description string) error {
+	if !addonNameRegex.MatchString(name) {
+		return fmt.Errorf("Invalid addon name '%s': use lower case letters, numbers, and dashes, such as access-mydb", name)
+	}
+	path := "addons/" + name + "/"
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("The addon %s already exists in %s", name, path)
+	}
+	if len(description) == 0 {
+		description = "FIXME: describe the " + name + " addon"
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	files := map[string]string{
+		AddonConfigName: fmt.Sprintf(addonConfigTemplate, description),
+		"Dockerfile":    fmt.Sprintf(addonDockerfileTemplate, description, name, name, name),
+	}
+	for file, content := range files {
+		if err := ioutil.WriteFile(path+file, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	// The new addon must pass the same checks as the addons that are shipped
+	problems := ValidateAddonConfig(path)
+	content, _ := ioutil.ReadFile(path + "Dockerfile")
+	if _, err := AddonInstructions(path+"Dockerfile", string(content)); err != nil {
+		problems = append(problems, ConfigProblem{File: path + "Dockerfile", Message: err.Error()})
+	}
+	for _, problem := range problems {
+		fmt.Println(problem.String())
+	}
+
+	fmt.Printf("Created the addon %s in %s\n", name, path)
+	fmt.Printf("Edit %s%s and %sDockerfile, then build with `--addons \"%s\"`\n", path, AddonConfigName, path, name)
+	return nil
+}
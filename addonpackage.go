@@ -0,0 +1,264 @@
+// addonpackage.go
+// Creates and unpacks addon packages. A package is a <name>-<version>.tar.gz
+// file with the files of the addon directory and a SHA256SUMS file, so addons
+// that are kept outside of this project can be given to --addons as one file.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AddonPackageChecksums lists the SHA-256 checksum of each file of an addon package, in the sha256sum format
+const AddonPackageChecksums = "SHA256SUMS"
+
+// isAddonPackage reports if an --addons value is an addon package instead of a directory or name
+func isAddonPackage(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// addonPackageFiles lists the files of an addon directory that are added to its package
+func addonPackageFiles(path string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative := strings.TrimPrefix(file, path)
+		if info.Mode().IsRegular() && relative != AddonPackageChecksums {
+			files = append(files, relative)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// PackageAddon writes an addon directory to a <name>-<version>.tar.gz package in the output directory
+func PackageAddon(path string, output string) (string, error) {
+	addon, err := LoadAddon(path)
+	if err != nil {
+		return "", err
+	}
+	if len(addon.Version) == 0 {
+		return "", fmt.Errorf("The addon %s requires a version in its %s to be packaged", addon.Name, AddonConfigName)
+	}
+	files, err := addonPackageFiles(addon.Path)
+	if err != nil {
+		return "", err
+	}
+
+	checksums := ""
+	for _, file := range files {
+		checksum, err := sha256File(addon.Path + file)
+		if err != nil {
+			return "", err
+		}
+		checksums += fmt.Sprintf("%s  %s\n", checksum, file)
+	}
+
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return "", err
+	}
+	packagePath := strings.TrimSuffix(output, "/") + "/" + addon.Name + "-" + addon.Version + ".tar.gz"
+	packageFile, err := os.Create(packagePath)
+	if err != nil {
+		return "", err
+	}
+	defer packageFile.Close()
+	gzipWriter := gzip.NewWriter(packageFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	header := &tar.Header{Name: AddonPackageChecksums, Mode: 0644, Size: int64(len(checksums))}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return "", err
+	}
+	if _, err := tarWriter.Write([]byte(checksums)); err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		info, err := os.Stat(addon.Path + file)
+		if err != nil {
+			return "", err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return "", err
+		}
+		header.Name = file
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return "", err
+		}
+		content, err := os.Open(addon.Path + file)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(tarWriter, content)
+		content.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return "", err
+	}
+	return packagePath, nil
+}
+
+// UnpackAddon unpacks an addon package into <directory>/<name>/ and checks each file against the package's SHA256SUMS.
+// The package must be named <name>-<version>.tar.gz with the version of its addon_config.yml.
+func UnpackAddon(packagePath string, directory string) (string, error) {
+	packageFile, err := os.Open(packagePath)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open the addon package %s, %s", packagePath, err.Error())
+	}
+	defer packageFile.Close()
+	gzipReader, err := gzip.NewReader(packageFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the addon package %s, %s", packagePath, err.Error())
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	// Unpack into a temporary directory until the addon name is known
+	base := filepath.Base(packagePath)
+	directory = strings.TrimSuffix(directory, "/") + "/"
+	unpackPath := directory + "." + base + "/"
+	if err := os.MkdirAll(unpackPath, 0755); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(unpackPath)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("Unable to read the addon package %s, %s", packagePath, err.Error())
+		}
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return "", fmt.Errorf("The addon package %s contains the file %s, which is outside of the addon directory", packagePath, header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(unpackPath+name, 0755); err != nil {
+				return "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(unpackPath+name), 0755); err != nil {
+				return "", err
+			}
+			file, err := os.OpenFile(unpackPath+name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0755|0600)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(file, tarReader)
+			file.Close()
+			if err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("The addon package %s contains %s, which is not a file or directory", packagePath, header.Name)
+		}
+	}
+
+	if err := checkAddonPackage(packagePath, unpackPath); err != nil {
+		return "", err
+	}
+
+	// The version in the package name must match the addon_config.yml
+	addon, err := LoadAddon(unpackPath)
+	if err != nil {
+		return "", err
+	}
+	stem := strings.TrimSuffix(strings.TrimSuffix(base, ".tar.gz"), ".tgz")
+	name := strings.TrimSuffix(stem, "-"+addon.Version)
+	if len(addon.Version) == 0 || name == stem || len(name) == 0 {
+		return "", fmt.Errorf("The addon package %s must be named <name>-<version>.tar.gz with the version %s of its %s",
+			packagePath, addon.Version, AddonConfigName)
+	}
+
+	addonPath := directory + name + "/"
+	if _, err := os.Stat(addonPath); err == nil {
+		return "", fmt.Errorf("The addon %s from the package %s has already been added", name, packagePath)
+	}
+	if err := os.Rename(unpackPath, addonPath); err != nil {
+		return "", err
+	}
+	return addonPath, nil
+}
+
+// checkAddonPackage checks that every file of an unpacked package is listed in its SHA256SUMS with the same checksum
+func checkAddonPackage(packagePath string, unpackPath string) error {
+	checksumFile, err := os.Open(unpackPath + AddonPackageChecksums)
+	if err != nil {
+		return fmt.Errorf("The addon package %s does not contain a %s file", packagePath, AddonPackageChecksums)
+	}
+	defer checksumFile.Close()
+
+	expected := make(map[string]string)
+	scanner := bufio.NewScanner(checksumFile)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid line in the %s of the addon package %s: %s", AddonPackageChecksums, packagePath, scanner.Text())
+		}
+		expected[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+
+	files, err := addonPackageFiles(unpackPath)
+	if err != nil {
+		return err
+	}
+	problems := []string{}
+	for _, file := range files {
+		checksum, err := sha256File(unpackPath + file)
+		if err != nil {
+			return err
+		}
+		if _, found := expected[file]; !found {
+			problems = append(problems, fmt.Sprintf("%s is not listed in %s", file, AddonPackageChecksums))
+		} else if !strings.EqualFold(checksum, expected[file]) {
+			problems = append(problems, fmt.Sprintf("%s has the SHA-256 checksum %s instead of %s", file, checksum, expected[file]))
+		}
+		delete(expected, file)
+	}
+	for file := range expected {
+		problems = append(problems, fmt.Sprintf("%s is listed in %s but is not in the package", file, AddonPackageChecksums))
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("The addon package " + packagePath + " is damaged:\n" + strings.Join(problems, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+// addonpackage_test.go
+// Tests the checks of the addon packages that are given to --addons.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAddonConfig = "version: 1.0.0\nimages:\n  programming:\n    dockerfiles: [Dockerfile]\n"
+
+// testPackageEntry is a file, directory, or link of a test addon package
+type testPackageEntry struct {
+	Name     string
+	Typeflag byte
+	Content  string
+	Linkname string
+}
+
+// testChecksums returns the SHA256SUMS of the files
+func testChecksums(files map[string]string) string {
+	checksums := ""
+	for name, content := range files {
+		checksum := sha256.Sum256([]byte(content))
+		checksums += fmt.Sprintf("%s  %s\n", hex.EncodeToString(checksum[:]), name)
+	}
+	return checksums
+}
+
+// writeTestPackage writes the entries to a tar.gz package
+func writeTestPackage(t *testing.T, path string, entries []testPackageEntry) {
+	packageFile, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer packageFile.Close()
+	gzipWriter := gzip.NewWriter(packageFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Name, Typeflag: entry.Typeflag, Mode: 0644, Size: int64(len(entry.Content)), Linkname: entry.Linkname}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if _, err := tarWriter.Write([]byte(entry.Content)); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+}
+
+// A package that is not a complete, unchanged addon is refused with the reason
+func TestUnpackAddonRefusesDamagedPackages(t *testing.T) {
+	files := map[string]string{AddonConfigName: testAddonConfig, "Dockerfile": "FROM centos:7\n"}
+	checksums := testChecksums(files)
+	valid := []testPackageEntry{
+		{Name: AddonPackageChecksums, Typeflag: tar.TypeReg, Content: checksums},
+		{Name: AddonConfigName, Typeflag: tar.TypeReg, Content: testAddonConfig},
+		{Name: "Dockerfile", Typeflag: tar.TypeReg, Content: "FROM centos:7\n"},
+	}
+
+	tests := map[string]struct {
+		packageName string
+		entries     []testPackageEntry
+		expected    string
+	}{
+		"parent directory": {
+			packageName: "access-mydb-1.0.0.tar.gz",
+			entries:     append(valid, testPackageEntry{Name: "../escape.sh", Typeflag: tar.TypeReg, Content: "exit 1\n"}),
+			expected:    "outside of the addon directory",
+		},
+		"absolute path": {
+			packageName: "access-mydb-1.0.0.tar.gz",
+			entries:     append(valid, testPackageEntry{Name: "/etc/profile.d/escape.sh", Typeflag: tar.TypeReg, Content: "exit 1\n"}),
+			expected:    "outside of the addon directory",
+		},
+		"symbolic link": {
+			packageName: "access-mydb-1.0.0.tar.gz",
+			entries:     append(valid, testPackageEntry{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}),
+			expected:    "which is not a file or directory",
+		},
+		"not in SHA256SUMS": {
+			packageName: "access-mydb-1.0.0.tar.gz",
+			entries:     append(valid, testPackageEntry{Name: "extra.sh", Typeflag: tar.TypeReg, Content: "exit 1\n"}),
+			expected:    "extra.sh is not listed in " + AddonPackageChecksums,
+		},
+		"wrong checksum": {
+			packageName: "access-mydb-1.0.0.tar.gz",
+			entries: []testPackageEntry{
+				{Name: AddonPackageChecksums, Typeflag: tar.TypeReg, Content: checksums},
+				{Name: AddonConfigName, Typeflag: tar.TypeReg, Content: testAddonConfig},
+				{Name: "Dockerfile", Typeflag: tar.TypeReg, Content: "FROM centos:6\n"},
+			},
+			expected: "Dockerfile has the SHA-256 checksum",
+		},
+		"missing file": {
+			packageName: "access-mydb-1.0.0.tar.gz",
+			entries:     valid[:2],
+			expected:    "Dockerfile is listed in " + AddonPackageChecksums + " but is not in the package",
+		},
+		"no SHA256SUMS": {
+			packageName: "access-mydb-1.0.0.tar.gz",
+			entries:     valid[1:],
+			expected:    "does not contain a " + AddonPackageChecksums + " file",
+		},
+		"wrong version": {
+			packageName: "access-mydb-2.0.0.tar.gz",
+			entries:     valid,
+			expected:    "must be named <name>-<version>.tar.gz with the version 1.0.0",
+		},
+		"no version": {
+			packageName: "access-mydb.tar.gz",
+			entries:     valid,
+			expected:    "must be named <name>-<version>.tar.gz",
+		},
+	}
+	for name, test := range tests {
+		directory, err := ioutil.TempDir("", "addonpackage")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		packagePath := directory + "/" + test.packageName
+		writeTestPackage(t, packagePath, test.entries)
+		addonPath, err := UnpackAddon(packagePath, directory+"/addons")
+		if err == nil {
+			t.Errorf("%s: expected an error, got the addon %s", name, addonPath)
+		} else if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error with '%s', got: %s", name, test.expected, err.Error())
+		}
+		if _, err := os.Stat(directory + "/escape.sh"); err == nil {
+			t.Errorf("%s: a file was written outside of the addon directory", name)
+		}
+		if _, err := os.Stat(directory + "/addons/access-mydb"); err == nil {
+			t.Errorf("%s: the addon was unpacked", name)
+		}
+		os.RemoveAll(directory)
+	}
+}
+
+// A package that PackageAddon writes is unpacked to the same files
+func TestPackageAddonRoundTrip(t *testing.T) {
+	directory, err := ioutil.TempDir("", "addonpackage")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(directory)
+
+	files := map[string]string{
+		AddonConfigName:       testAddonConfig,
+		"Dockerfile":          "FROM centos:7\nCOPY mydb_sasserver.sh /tmp/\n",
+		"mydb_sasserver.sh":   "export MYDB_HOME=/opt/mydb\n",
+		"config/mydb.ini":     "[mydb]\n",
+		"config/nested/a.txt": "a\n",
+	}
+	addonPath := directory + "/source/access-mydb/"
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(addonPath+name), 0755); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(addonPath+name, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	packagePath, err := PackageAddon(addonPath, directory+"/packages")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !strings.HasSuffix(packagePath, "/access-mydb-1.0.0.tar.gz") {
+		t.Errorf("unexpected package name %s", packagePath)
+	}
+	unpackedPath, err := UnpackAddon(packagePath, directory+"/addons")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if unpackedPath != directory+"/addons/access-mydb/" {
+		t.Errorf("unexpected addon path %s", unpackedPath)
+	}
+	for name, content := range files {
+		unpacked, err := ioutil.ReadFile(unpackedPath + name)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+		} else if string(unpacked) != content {
+			t.Errorf("%s: expected %q, got %q", name, content, string(unpacked))
+		}
+	}
+
+	if _, err := UnpackAddon(packagePath, directory+"/addons"); err == nil {
+		t.Errorf("expected an error when the addon is unpacked twice")
+	}
+}
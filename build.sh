@@ -148,6 +148,114 @@ while [[ $# -gt 0 ]]; do
             shift # past argument
             export GENERATE_MANIFESTS_ONLY=true
             ;;
+        validate)
+            shift # past argument
+            VALIDATE_ONLY=true
+            ;;
+        addons)
+            shift # past argument
+            RUN_ADDONS_COMMAND=true
+            ADDONS_COMMAND=("$@") # The remaining arguments belong to the addons command
+            break
+            ;;
+        --config)
+            shift # past argument
+            CONFIG_OVERLAYS+=("$1")
+            shift # past value
+            ;;
+        --artifact-cache)
+            shift # past argument
+            ARTIFACT_CACHE="$1"
+            shift # past value
+            ;;
+        --build-arg)
+            shift # past argument
+            BUILD_ARGS+=("$1")
+            shift # past value
+            ;;
+        --label)
+            shift # past argument
+            LABELS+=("$1")
+            shift # past value
+            ;;
+        --http-proxy)
+            shift # past argument
+            HTTP_PROXY_URL="$1"
+            shift # past value
+            ;;
+        --https-proxy)
+            shift # past argument
+            HTTPS_PROXY_URL="$1"
+            shift # past value
+            ;;
+        --no-proxy)
+            shift # past argument
+            NO_PROXY_HOSTS="$1"
+            shift # past value
+            ;;
+        --repositories)
+            shift # past argument
+            REPOSITORIES="$1"
+            shift # past value
+            ;;
+        --dockerfile-templates)
+            shift # past argument
+            DOCKERFILE_TEMPLATES="$1"
+            shift # past value
+            ;;
+        --strip-build-tools)
+            shift # past argument
+            STRIP_BUILD_TOOLS=true
+            ;;
+        --squash)
+            shift # past argument
+            SQUASH=true
+            ;;
+        --skip-sbom)
+            shift # past argument
+            SKIP_SBOM=true
+            ;;
+        --sbom-label)
+            shift # past argument
+            SBOM_LABEL=true
+            ;;
+        --require-sbom)
+            shift # past argument
+            REQUIRE_SBOM=true
+            ;;
+        --lint-ignore)
+            shift # past argument
+            LINT_IGNORE="$1"
+            shift # past value
+            ;;
+        --fail-on-lint-errors)
+            shift # past argument
+            FAIL_ON_LINT_ERRORS=true
+            ;;
+        --manifest-format)
+            shift # past argument
+            export MANIFEST_FORMAT="$1"
+            shift # past value
+            ;;
+        --kustomize-overlays)
+            shift # past argument
+            export KUSTOMIZE_OVERLAYS="$1"
+            shift # past value
+            ;;
+        --kubernetes-version)
+            shift # past argument
+            export KUBERNETES_VERSION="$1"
+            shift # past value
+            ;;
+        --skip-manifest-validation)
+            shift # past argument
+            export SKIP_MANIFEST_VALIDATION=true
+            ;;
+        --diff-against)
+            shift # past argument
+            export DIFF_AGAINST="$1"
+            shift # past value
+            ;;
         -b|--build-only)
             shift # past argument
             export BUILD_ONLY="$1"
@@ -178,6 +286,13 @@ SAS_BUILD_CONTAINER_TAG=${sas_recipe_version}-${datetime}-${git_sha}
 # Pass each argument if it exists. Allow the sas-container-recipes binary to catch any missing
 # arguments that are required and fill in the default values of those that are not provided.
 run_args=""
+
+# The commit of this project is added to each image as the org.opencontainers.image.revision label
+git_revision=$(git rev-parse HEAD 2>/dev/null)
+if [[ -n ${git_revision} ]]; then
+    run_args="${run_args} --source-revision ${git_revision}"
+fi
+
 if [[ -n ${SAS_RPM_REPO_URL} ]]; then
     run_args="${run_args} --mirror-url ${SAS_RPM_REPO_URL}"
 fi
@@ -218,7 +333,18 @@ if [[ -n ${ADDONS} ]]; then
     ADDONS=${ADDONS## } # remove trailing space
     ADDONS=${ADDONS//  /} # replace multiple spaces with a single space
     ADDONS=${ADDONS// /,} # replace spaces with a comma
-    run_args="${run_args} --addons ${ADDONS}"
+
+    # Mount each addon package into the builder since it may be outside of this project
+    addon_list=""
+    IFS=',' read -ra addon_items <<< "${ADDONS}"
+    for addon in "${addon_items[@]}"; do
+        if [[ ${addon} == *.tar.gz || ${addon} == *.tgz ]]; then
+            addon_mounts="${addon_mounts} -v $(realpath ${addon}):/addon-packages/$(basename ${addon}):ro"
+            addon="/addon-packages/$(basename ${addon})"
+        fi
+        addon_list="${addon_list:+${addon_list},}${addon}"
+    done
+    run_args="${run_args} --addons ${addon_list}"
 fi
 
 if [[ -n ${CAS_VIRTUAL_HOST} ]]; then
@@ -245,10 +371,119 @@ if [[ -n ${PROJECT_NAME} ]]; then
     run_args="${run_args} --project-name ${PROJECT_NAME}"
 fi
 
+# Mount each config overlay into the builder since it may be outside of this project
+config_mounts=""
+for index in "${!CONFIG_OVERLAYS[@]}"; do
+    config_overlay="${CONFIG_OVERLAYS[${index}]}"
+    config_mounts="${config_mounts} -v $(realpath ${config_overlay}):/config/${index}-$(basename ${config_overlay})"
+    run_args="${run_args} --config /config/${index}-$(basename ${config_overlay})"
+done
+
+# Mount the artifact cache into the builder since it is outside of this project
+artifact_mount=""
+if [[ -n ${ARTIFACT_CACHE} ]]; then
+    artifact_mount="-v $(realpath ${ARTIFACT_CACHE}):/artifacts:ro"
+    run_args="${run_args} --artifact-cache /artifacts"
+fi
+
+# Mount the Dockerfile template overrides into the builder since they may be outside of this project
+templates_mount=""
+if [[ -n ${DOCKERFILE_TEMPLATES} ]]; then
+    templates_mount="-v $(realpath ${DOCKERFILE_TEMPLATES}):/dockerfile-templates:ro"
+    run_args="${run_args} --dockerfile-templates /dockerfile-templates"
+fi
+
+if [[ ${STRIP_BUILD_TOOLS} == true ]]; then
+    run_args="${run_args} --strip-build-tools"
+fi
+
+if [[ ${SQUASH} == true ]]; then
+    run_args="${run_args} --squash"
+fi
+
+if [[ ${SKIP_SBOM} == true ]]; then
+    run_args="${run_args} --skip-sbom"
+fi
+
+if [[ ${SBOM_LABEL} == true ]]; then
+    run_args="${run_args} --sbom-label"
+fi
+
+if [[ ${REQUIRE_SBOM} == true ]]; then
+    run_args="${run_args} --require-sbom"
+fi
+
+if [[ -n ${LINT_IGNORE} ]]; then
+    run_args="${run_args} --lint-ignore ${LINT_IGNORE// /,}"
+fi
+
+if [[ ${FAIL_ON_LINT_ERRORS} == true ]]; then
+    run_args="${run_args} --fail-on-lint-errors"
+fi
+
+for build_arg in "${BUILD_ARGS[@]}"; do
+    run_args="${run_args} --build-arg ${build_arg}"
+done
+
+for label in "${LABELS[@]}"; do
+    run_args="${run_args} --label ${label}"
+done
+
+# The proxy is also given to the builder, which downloads the orchestration tool and checks the mirror
+proxy_args=""
+proxy_env=""
+if [[ -n ${HTTP_PROXY_URL} ]]; then
+    run_args="${run_args} --http-proxy ${HTTP_PROXY_URL}"
+    proxy_args="${proxy_args} --build-arg HTTP_PROXY=${HTTP_PROXY_URL}"
+    proxy_env="${proxy_env} -e HTTP_PROXY=${HTTP_PROXY_URL}"
+fi
+if [[ -n ${HTTPS_PROXY_URL} ]]; then
+    run_args="${run_args} --https-proxy ${HTTPS_PROXY_URL}"
+    proxy_args="${proxy_args} --build-arg HTTPS_PROXY=${HTTPS_PROXY_URL}"
+    proxy_env="${proxy_env} -e HTTPS_PROXY=${HTTPS_PROXY_URL}"
+fi
+if [[ -n ${NO_PROXY_HOSTS} ]]; then
+    run_args="${run_args} --no-proxy ${NO_PROXY_HOSTS}"
+    proxy_args="${proxy_args} --build-arg NO_PROXY=${NO_PROXY_HOSTS}"
+    proxy_env="${proxy_env} -e NO_PROXY=${NO_PROXY_HOSTS}"
+fi
+
+# Mount the package repository files into the builder since they may be outside of this project
+repositories_mount=""
+if [[ -n ${REPOSITORIES} ]]; then
+    repositories_mount="-v $(realpath ${REPOSITORIES}):/repositories:ro"
+    run_args="${run_args} --repositories /repositories"
+fi
+
+if [[ -n ${MANIFEST_FORMAT} ]]; then
+    run_args="${run_args} --manifest-format ${MANIFEST_FORMAT// /,}"
+fi
+
+if [[ -n ${KUSTOMIZE_OVERLAYS} ]]; then
+    run_args="${run_args} --kustomize-overlays ${KUSTOMIZE_OVERLAYS// /,}"
+fi
+
+if [[ -n ${KUBERNETES_VERSION} ]]; then
+    run_args="${run_args} --kubernetes-version ${KUBERNETES_VERSION}"
+fi
+
+if [[ -n ${SKIP_MANIFEST_VALIDATION} ]]; then
+    run_args="${run_args} --skip-manifest-validation"
+fi
+
+if [[ -n ${DIFF_AGAINST} ]]; then
+    run_args="${run_args} --diff-against ${DIFF_AGAINST}"
+fi
+
 if [[ -n ${BUILD_ONLY} ]]; then
     run_args="${run_args} --build-only ${BUILD_ONLY}"
 fi
 
+# The validate command must be the first argument of the sas-container-recipes binary
+if [[ -n ${VALIDATE_ONLY} ]]; then
+    run_args="validate ${run_args}"
+fi
+
 echo "==============================="
 echo "Building Docker Build Container"
 echo "==============================="
@@ -261,10 +496,21 @@ docker build . \
     --label sas.recipe.builder.version=${SAS_DOCKER_TAG} \
     --build-arg USER_UID=${UID} \
     --build-arg DOCKER_GID=${DOCKER_GID} \
+    ${proxy_args} \
     --tag sas-container-recipes-builder:${SAS_DOCKER_TAG} \
     --file Dockerfile \
 
 
+# The addons command only needs the addons directory, which is mounted so new addons are kept
+if [[ -n ${RUN_ADDONS_COMMAND} ]]; then
+    docker run --rm \
+        -u ${UID}:${DOCKER_GID} \
+        -v ${PWD}/addons:/sas-container-recipes/addons \
+        -v ${PWD}/builds:/sas-container-recipes/builds \
+        sas-container-recipes-builder:${SAS_DOCKER_TAG} addons "${ADDONS_COMMAND[@]}"
+    exit $?
+fi
+
 echo
 echo "=============================="
 echo "Running Docker Build Container"
@@ -280,6 +526,12 @@ if [[ -f ${DOCKER_CONFIG_PATH} ]]; then
         -v $(realpath ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}):/$(basename ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}) \
         -v ${PWD}/builds:/sas-container-recipes/builds \
         -v /var/run/docker.sock:/var/run/docker.sock \
+        ${config_mounts} \
+        ${artifact_mount} \
+        ${templates_mount} \
+        ${repositories_mount} \
+        ${proxy_env} \
+        ${addon_mounts} \
         -v ${HOME}/.docker/config.json:/home/sas/.docker/config.json \
         sas-container-recipes-builder:${SAS_DOCKER_TAG} ${run_args}
 else 
@@ -289,6 +541,12 @@ else
         -v $(realpath ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}):/$(basename ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}) \
         -v ${PWD}/builds:/sas-container-recipes/builds \
         -v /var/run/docker.sock:/var/run/docker.sock \
+        ${config_mounts} \
+        ${artifact_mount} \
+        ${templates_mount} \
+        ${repositories_mount} \
+        ${proxy_env} \
+        ${addon_mounts} \
         sas-container-recipes-builder:${SAS_DOCKER_TAG} ${run_args}
 fi
 docker logs -f ${SAS_BUILD_CONTAINER_NAME}
@@ -0,0 +1,177 @@
+// compose.go
+// Creates a docker-compose.yml for the multiple deployment type from the same
+// service definitions that are used to generate the Kubernetes manifests, so
+// the deployment can also run on a host without Kubernetes.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ComposeFile is the content of a docker-compose.yml file
+type ComposeFile struct {
+	Version  string                       `yaml:"version"`
+	Services map[string]ComposeService    `yaml:"services"`
+	Volumes  map[string]map[string]string `yaml:"volumes,omitempty"`
+}
+
+// ComposeService is a single container in the docker-compose.yml file
+type ComposeService struct {
+	Image       string              `yaml:"image"`
+	Hostname    string              `yaml:"hostname"`
+	Ports       []string            `yaml:"ports,omitempty"`
+	Environment map[string]string   `yaml:"environment,omitempty"`
+	Volumes     []string            `yaml:"volumes,omitempty"`
+	User        string              `yaml:"user,omitempty"`
+	Healthcheck *ComposeHealthcheck `yaml:"healthcheck,omitempty"`
+}
+
+// ComposeHealthcheck is the healthcheck of a service in the docker-compose.yml file
+type ComposeHealthcheck struct {
+	Test        []string `yaml:"test"`
+	Interval    string   `yaml:"interval"`
+	Timeout     string   `yaml:"timeout"`
+	StartPeriod string   `yaml:"start_period"`
+	Retries     int      `yaml:"retries"`
+}
+
+// GetComposeFile converts the manifest inputs into a compose file.
+// Each service is named like its Kubernetes service so the containers
+// find each other with the same host names, e.g. <project_name>-cas.
+func GetComposeFile(inputs *ManifestInputs) (ComposeFile, error) {
+	compose := ComposeFile{
+		Version:  "3.7",
+		Services: make(map[string]ComposeService),
+		Volumes:  make(map[string]map[string]string),
+	}
+	registry, registryNamespace := inputs.Registry()
+
+	for _, name := range inputs.ServiceNames() {
+		serviceName := inputs.ProjectName() + "-" + inputs.ResourceName(name)
+		service := ComposeService{
+			Image:       fmt.Sprintf("%s-%s:%s", inputs.ProjectName(), name, inputs.Tag),
+			Hostname:    serviceName,
+			Environment: make(map[string]string),
+		}
+		if len(registry) > 0 {
+			service.Image = registry + "/" + registryNamespace + "/" + service.Image
+		}
+
+		// The config file lists ports as "<container>:<host>" while compose publishes "<host>:<container>"
+		for _, item := range inputs.Settings.Services[name].Ports {
+			containerPort, hostPort := splitKeyValue(item, ":")
+			if len(hostPort) == 0 {
+				hostPort = containerPort
+			}
+			service.Ports = append(service.Ports, strings.TrimSpace(hostPort)+":"+containerPort)
+		}
+
+		// Same environment as util/static-roles-multiple/manifests/templates/pets_k8s.j2
+		service.Environment["DEPLOYMENT_NAME"] = inputs.ProjectName()
+		if name == "sas-casserver-primary" {
+			service.Environment["SERVICE_NAME"] = "cascontroller"
+		}
+		for _, item := range inputs.Environment(name) {
+			service.Environment[item[0]] = item[1]
+		}
+
+		// Kubernetes decodes the secrets before they reach the container, so do the same here.
+		// Values of keys that end with _ENC are already base64 encoded.
+		for _, item := range inputs.Secrets(name) {
+			key, value := item[0], item[1]
+			if strings.HasSuffix(key, "_ENC") {
+				decoded, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					return compose, fmt.Errorf("Unable to decode the %s secret for %s: %s", key, name, err.Error())
+				}
+				value = string(decoded)
+			}
+			if key == "SETINIT_TEXT_ENC" {
+				key = "SETINIT_TEXT"
+			}
+			service.Environment[key] = value
+		}
+
+		// Named volumes replace the Kubernetes emptyDir volumes
+		for _, item := range inputs.Volumes(name) {
+			volumeName := serviceName + "-" + item[0]
+			compose.Volumes[volumeName] = map[string]string{}
+			service.Volumes = append(service.Volumes, volumeName+":"+item[1])
+		}
+
+		// The files of the ConfigMaps and Secrets are read-only bind mounts of the copies in files/<service>/
+		for _, file := range inputs.Files(name) {
+			service.Volumes = append(service.Volumes, fmt.Sprintf("./files/%s/%s:%s:ro", name, file.Name, file.MountPath))
+		}
+
+		// The healthcheck and user of the image are also set in the compose file, like the probes
+		// and securityContext of the Kubernetes manifests
+		service.User = inputs.Settings.Services[name].User
+		if healthcheck := inputs.Settings.Services[name].Healthcheck; len(healthcheck.Command) > 0 {
+			healthcheck = healthcheck.withDefaults()
+			service.Healthcheck = &ComposeHealthcheck{
+				Test:        []string{"CMD-SHELL", healthcheck.Command},
+				Interval:    fmt.Sprintf("%ds", healthcheck.Interval),
+				Timeout:     fmt.Sprintf("%ds", healthcheck.Timeout),
+				StartPeriod: fmt.Sprintf("%ds", healthcheck.StartPeriod),
+				Retries:     healthcheck.Retries,
+			}
+		}
+		compose.Services[serviceName] = service
+	}
+	return compose, nil
+}
+
+// GenerateCompose writes <build>/<SAS_MANIFEST_DIR>/compose/docker-compose.yml
+func (order *SoftwareOrder) GenerateCompose() error {
+	order.WriteLog(true, "Creating docker-compose.yml ...")
+	inputs, err := order.LoadManifestInputs()
+	if err != nil {
+		return err
+	}
+
+	composePath := inputs.ManifestPath() + "compose/"
+	if err := os.MkdirAll(composePath, 0744); err != nil {
+		return err
+	}
+	for name := range inputs.CustomVolumes {
+		order.WriteLog(true, fmt.Sprintf("[WARNING] The custom_volumes of %s are Kubernetes specific and are not added to the docker-compose.yml", name))
+	}
+
+	compose, err := GetComposeFile(inputs)
+	if err != nil {
+		return err
+	}
+	for _, name := range inputs.ServiceNames() {
+		if err := inputs.CopyFiles(name, composePath+"files"); err != nil {
+			return err
+		}
+	}
+	header := "# Generated by SAS Container Recipes. Start the deployment with `docker compose up -d`.\n" +
+		"# NOTE: the services' environment contains the license from the Software Order Email.\n"
+	if err := writeYAMLFile(composePath+"docker-compose.yml", header, compose); err != nil {
+		return err
+	}
+
+	order.WriteLog(true, "Finished creating docker-compose.yml "+composePath)
+	return nil
+}
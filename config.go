@@ -0,0 +1,242 @@
+// config.go
+// Merges an ordered list of --config overlay files over the shipped
+// config-<deployment-type>.yml so site and environment customizations
+// do not require editing the files in this project.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EffectiveConfigName is the merged config file that is written to the build directory
+const EffectiveConfigName = "config-effective.yml"
+
+// ConfigOverlay is a container's entry in a --config overlay file.
+//
+// Items of the ports, environment, secrets, volumes, resources, build_args, labels, and files
+// lists are merged into the container's lists by key: the container port for ports, the
+// name of a file, and the name before the "=" for the others. An item with the same key replaces the
+// existing item in place and other items are appended. The roles list is always replaced
+// since the order of the roles matters, and so are the base_image, healthcheck, user,
+// entrypoint, and cmd when they are set. List a field in replace to replace its whole
+// list instead, which is also how items are removed.
+type ConfigOverlay struct {
+	ContainerConfig `yaml:",inline"`
+	Replace         []string `yaml:"replace"`
+}
+
+// Fields that can be listed in an overlay's replace list
+var configOverlayFields = []string{"ports", "environment", "secrets", "roles", "volumes", "resources.limits", "resources.requests",
+	"build_args", "labels", "files"}
+
+// configItemKey returns the key that a list item is merged on
+func configItemKey(field string, item string) string {
+	if field == "ports" {
+		return strings.TrimSpace(strings.Split(item, ":")[0])
+	}
+	key, _ := splitKeyValue(item, "=")
+	return key
+}
+
+// mergeConfigList merges the overlay items into the base items of a list
+func mergeConfigList(field string, base []string, overlay []string, replace []string) []string {
+	if overlay == nil {
+		return base
+	}
+	if field == "roles" || stringInSlice(field, replace) {
+		return append([]string{}, overlay...)
+	}
+	result := append([]string{}, base...)
+	for _, item := range overlay {
+		key := configItemKey(field, item)
+		found := false
+		for index, existing := range result {
+			if configItemKey(field, existing) == key {
+				result[index] = item
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// mergeConfigFileList merges the overlay files into the base files by their name
+func mergeConfigFileList(base []ContainerFile, overlay []ContainerFile, replace []string) []ContainerFile {
+	if overlay == nil {
+		return base
+	}
+	if stringInSlice("files", replace) {
+		return append([]ContainerFile{}, overlay...)
+	}
+	result := append([]ContainerFile{}, base...)
+	for _, file := range overlay {
+		found := false
+		for index, existing := range result {
+			if existing.Name == file.Name {
+				result[index] = file
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// resolveConfigFiles returns the files with each source relative to a directory, and checks that the sources exist
+func resolveConfigFiles(files []ContainerFile, directory string, configPath string) ([]ContainerFile, error) {
+	result := []ContainerFile{}
+	for _, file := range files {
+		if len(file.Source) > 0 && !filepath.IsAbs(file.Source) {
+			file.Source = filepath.Join(directory, file.Source)
+		}
+		if info, err := os.Stat(file.Source); err != nil || info.IsDir() {
+			return nil, fmt.Errorf("The source '%s' of the file %s in %s is not a file", file.Source, file.Name, configPath)
+		}
+		result = append(result, file)
+	}
+	return result, nil
+}
+
+// MergeConfig applies an overlay to a container's config
+func MergeConfig(base ContainerConfig, overlay ConfigOverlay) ContainerConfig {
+	base.Ports = mergeConfigList("ports", base.Ports, overlay.Ports, overlay.Replace)
+	base.Environment = mergeConfigList("environment", base.Environment, overlay.Environment, overlay.Replace)
+	base.Secrets = mergeConfigList("secrets", base.Secrets, overlay.Secrets, overlay.Replace)
+	base.Roles = mergeConfigList("roles", base.Roles, overlay.Roles, overlay.Replace)
+	base.Volumes = mergeConfigList("volumes", base.Volumes, overlay.Volumes, overlay.Replace)
+	base.Resources.Limits = mergeConfigList("resources.limits", base.Resources.Limits, overlay.Resources.Limits, overlay.Replace)
+	base.Resources.Requests = mergeConfigList("resources.requests", base.Resources.Requests, overlay.Resources.Requests, overlay.Replace)
+	base.BuildArgs = mergeConfigList("build_args", base.BuildArgs, overlay.BuildArgs, overlay.Replace)
+	base.Labels = mergeConfigList("labels", base.Labels, overlay.Labels, overlay.Replace)
+	base.Files = mergeConfigFileList(base.Files, overlay.Files, overlay.Replace)
+	if len(overlay.BaseImage) > 0 {
+		base.BaseImage = overlay.BaseImage
+	}
+	if len(overlay.Healthcheck.Command) > 0 {
+		base.Healthcheck = overlay.Healthcheck
+	}
+	if len(overlay.User) > 0 {
+		base.User = overlay.User
+	}
+	if len(overlay.Entrypoint) > 0 {
+		base.Entrypoint = overlay.Entrypoint
+	}
+	if len(overlay.Cmd) > 0 {
+		base.Cmd = overlay.Cmd
+	}
+	return base
+}
+
+// MergeConfigFiles reads the shipped config file, adds the manifest items of each addon,
+// and applies each overlay file in order
+func MergeConfigFiles(basePath string, addons []*Addon, overlayPaths []string) (map[string]ContainerConfig, error) {
+	result := make(map[string]ContainerConfig)
+	content, err := ioutil.ReadFile(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the config file %s, %s", basePath, err.Error())
+	}
+	if err := yaml.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("Unable to parse the config file %s, %s", basePath, err.Error())
+	}
+
+	for name, config := range result {
+		if config.Files, err = resolveConfigFiles(config.Files, filepath.Dir(basePath), basePath); err != nil {
+			return nil, err
+		}
+		result[name] = config
+	}
+
+	for _, addon := range addons {
+		for name, manifest := range addon.Manifests {
+			overlay := manifest.overlay()
+			if overlay.Files, err = resolveConfigFiles(overlay.Files, addon.Path, addon.Path+AddonConfigName); err != nil {
+				return nil, err
+			}
+			result[name] = MergeConfig(result[name], overlay)
+		}
+	}
+
+	for _, overlayPath := range overlayPaths {
+		overlays := make(map[string]ConfigOverlay)
+		content, err := ioutil.ReadFile(overlayPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the --config file %s, %s", overlayPath, err.Error())
+		}
+		if err := yaml.UnmarshalStrict(content, &overlays); err != nil {
+			return nil, fmt.Errorf("Unable to parse the --config file %s, %s", overlayPath, err.Error())
+		}
+		for name, overlay := range overlays {
+			for _, field := range overlay.Replace {
+				if !stringInSlice(field, configOverlayFields) {
+					return nil, fmt.Errorf("Invalid replace field '%s' for %s in the --config file %s: choose between %s",
+						field, name, overlayPath, strings.Join(configOverlayFields, ", "))
+				}
+			}
+			if overlay.Files, err = resolveConfigFiles(overlay.Files, filepath.Dir(overlayPath), overlayPath); err != nil {
+				return nil, err
+			}
+			result[name] = MergeConfig(result[name], overlay)
+		}
+	}
+	return result, nil
+}
+
+// LoadConfig merges the addons' manifest items and the --config overlays over the shipped
+// config-<deployment-type>.yml and writes the result to the build directory.
+// The containers then read their config from that file.
+func (order *SoftwareOrder) LoadConfig() error {
+	config, err := MergeConfigFiles(order.ConfigPath, order.AddonConfigs, order.ConfigOverlays)
+	if err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("# The effective container config of this build: %s\n", order.ConfigPath)
+	for _, addon := range order.AddonConfigs {
+		if len(addon.Manifests) > 0 {
+			header += fmt.Sprintf("# merged with the manifests of the addon %s\n", addon.Name)
+		}
+	}
+	for _, overlayPath := range order.ConfigOverlays {
+		header += fmt.Sprintf("# merged with %s\n", overlayPath)
+	}
+	effectiveConfigPath := order.BuildPath + EffectiveConfigName
+	if err := ioutil.WriteFile(effectiveConfigPath, append([]byte(header), content...), 0644); err != nil {
+		return err
+	}
+	order.WriteLog(true, "Wrote the effective config to "+effectiveConfigPath)
+	order.ConfigPath = effectiveConfigPath
+	return nil
+}
@@ -0,0 +1,103 @@
+// config_test.go
+// Tests how the --config overlays are merged into the containers' config.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// An overlay item replaces the base item with the same key in place, and the other items are appended
+func TestMergeConfigList(t *testing.T) {
+	tests := map[string]struct {
+		field    string
+		base     []string
+		overlay  []string
+		replace  []string
+		expected []string
+	}{
+		"no overlay": {
+			field:    "environment",
+			base:     []string{"A=1", "B=2"},
+			overlay:  nil,
+			expected: []string{"A=1", "B=2"},
+		},
+		"replaced in place": {
+			field:    "environment",
+			base:     []string{"A=1", "B=2", "C=3"},
+			overlay:  []string{"D=4", "B=x"},
+			expected: []string{"A=1", "B=x", "C=3", "D=4"},
+		},
+		"value with =": {
+			field:    "secrets",
+			base:     []string{"PASSWORD=a=b"},
+			overlay:  []string{"PASSWORD=c=d"},
+			expected: []string{"PASSWORD=c=d"},
+		},
+		"ports by container port": {
+			field:    "ports",
+			base:     []string{"80:80", "443:443"},
+			overlay:  []string{"80:8080/tcp", "5570:5570"},
+			expected: []string{"80:8080/tcp", "443:443", "5570:5570"},
+		},
+		"roles are replaced": {
+			field:    "roles",
+			base:     []string{"sas-install", "programming"},
+			overlay:  []string{"programming"},
+			expected: []string{"programming"},
+		},
+		"replace list": {
+			field:    "volumes",
+			base:     []string{"data=/data", "cache=/cache"},
+			overlay:  []string{"cache=/var/cache"},
+			replace:  []string{"volumes"},
+			expected: []string{"cache=/var/cache"},
+		},
+		"replace removes": {
+			field:    "labels",
+			base:     []string{"a=b"},
+			overlay:  []string{},
+			replace:  []string{"labels"},
+			expected: []string{},
+		},
+	}
+	for name, test := range tests {
+		result := mergeConfigList(test.field, test.base, test.overlay, test.replace)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s: expected %v, got %v", name, test.expected, result)
+		}
+	}
+}
+
+// A file of an overlay replaces the base file with the same name in place
+func TestMergeConfigFileList(t *testing.T) {
+	base := []ContainerFile{{Name: "a.conf", MountPath: "/etc/a.conf"}, {Name: "b.conf", MountPath: "/etc/b.conf"}}
+	overlay := []ContainerFile{{Name: "c.conf", MountPath: "/etc/c.conf"}, {Name: "a.conf", MountPath: "/opt/a.conf", Secret: true}}
+
+	expected := []ContainerFile{{Name: "a.conf", MountPath: "/opt/a.conf", Secret: true}, base[1], overlay[0]}
+	if result := mergeConfigFileList(base, overlay, nil); !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %v, got %v", expected, result)
+	}
+	if result := mergeConfigFileList(base, overlay, []string{"files"}); !reflect.DeepEqual(result, overlay) {
+		t.Errorf("expected %v, got %v", overlay, result)
+	}
+	if result := mergeConfigFileList(base, nil, nil); !reflect.DeepEqual(result, base) {
+		t.Errorf("expected %v, got %v", base, result)
+	}
+}
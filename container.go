@@ -33,12 +33,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"gopkg.in/yaml.v2"
 )
@@ -68,11 +69,12 @@ type Container struct {
 	SoftwareOrder *SoftwareOrder
 
 	// Basic default attributes set on creation
-	Status    State  // See `type State` above
-	Name      string // Hostname without a project name prefix - such as httpproxy, sas-casserver-primary, consul
-	Tag       string // Use container.GetTag or container.GetWholeImageName instead
-	BaseImage string // Set by the order's --base-image argument
-	IsStatic  bool   // Set by the CreateDockerContext function. Determined by the existance of the util/static-roles-<deployment>/<container-name> directory
+	Status    State              // See `type State` above
+	Name      string             // Hostname without a project name prefix - such as httpproxy, sas-casserver-primary, consul
+	Tag       string             // Use container.GetTag or container.GetWholeImageName instead
+	BaseImage string             // Set by the order's --base-image argument or the base_image of the container's config
+	Platform  PlatformDefinition // Detected from the base image by order.DetectPlatform
+	IsStatic  bool               // Set by the CreateDockerContext function. Determined by the existance of the util/static-roles-<deployment>/<container-name> directory
 
 	// Builder attributes
 	BuildArgs         map[string]*string // Arguments that are passed into the Docker builder https://docs.docker.com/engine/reference/commandline/build/
@@ -92,6 +94,14 @@ type Container struct {
 	PushStart  time.Time // Set when the push command is sent to the Docker client
 	PushEnd    time.Time // Set when the push command receives a success signal from the Docker client
 	ImageSize  int64     // Set after the build process by the Docker client ImageList command
+
+	// With --strip-build-tools or --squash, the size of the image with the build tooling and each layer
+	ReferenceSize int64
+
+	LintProblems []LintProblem // The problems that were found in the generated Dockerfile
+
+	ContextDigests map[string]string // The sha256 digest of each file of the Docker context, for the provenance of the image
+	SBOMPackages   int               // The number of packages in the SBOM of the image, see container.WriteSBOM
 }
 
 // ContainerConfig each container has a configmap which define Docker layers.
@@ -108,6 +118,50 @@ type ContainerConfig struct {
 		Limits   []string `yaml:"limits"`
 		Requests []string `yaml:"requests"`
 	} `yaml:"resources"`
+	BaseImage string   `yaml:"base_image,omitempty"` // Replaces the --base-image for this container's image
+	BuildArgs []string `yaml:"build_args,omitempty"` // NAME=value build arguments that are added to the --build-arg arguments
+	Labels    []string `yaml:"labels,omitempty"`     // name=value labels that are added to the --label arguments
+
+	Healthcheck ContainerHealthcheck `yaml:"healthcheck,omitempty"` // The HEALTHCHECK of the image and the probes of its manifests
+	User        string               `yaml:"user,omitempty"`        // The USER that runs the services, such as 1001:1001
+	Entrypoint  []string             `yaml:"entrypoint,omitempty"`  // Replaces the tini entrypoint of the image
+	Cmd         []string             `yaml:"cmd,omitempty"`         // The CMD of the image, which is passed to the entrypoint
+
+	Files []ContainerFile `yaml:"files,omitempty"` // The files that are mounted into the container of the deployments, such as sssd.conf
+}
+
+// ContainerFile is a text file that is mounted into the container of the deployments from a ConfigMap,
+// or from a Secret when the file has credentials. The docker-compose.yml mounts a read-only copy of the file.
+type ContainerFile struct {
+	Name      string `yaml:"name"`       // The key of the file in the ConfigMap or Secret, such as sssd.conf
+	Source    string `yaml:"source"`     // The file on the build machine, relative to the addon directory or the config file
+	MountPath string `yaml:"mount_path"` // The absolute path of the file in the container
+	Secret    bool   `yaml:"secret"`     // The file is mounted from a Secret instead of a ConfigMap
+	Mode      int    `yaml:"mode"`       // The permissions of the file, such as 0600. Default: 0644
+}
+
+// ContainerHealthcheck is a command that checks the services of a container. It is the HEALTHCHECK
+// of the image and the readiness probe of the Kubernetes manifests, and their liveness probe if it has a start_period.
+type ContainerHealthcheck struct {
+	Command     string `yaml:"command,omitempty"`      // Run with /bin/sh -c, such as curl --fail http://localhost/
+	Interval    int    `yaml:"interval,omitempty"`     // Seconds between each check. Default: 30
+	Timeout     int    `yaml:"timeout,omitempty"`      // Seconds before a check fails. Default: 30
+	StartPeriod int    `yaml:"start_period,omitempty"` // Seconds that the services are given to start before a failed check counts
+	Retries     int    `yaml:"retries,omitempty"`      // Failed checks in a row before the container is unhealthy. Default: 3
+}
+
+// withDefaults returns the healthcheck with Docker's default interval, timeout, and retries
+func (healthcheck ContainerHealthcheck) withDefaults() ContainerHealthcheck {
+	if healthcheck.Interval == 0 {
+		healthcheck.Interval = 30
+	}
+	if healthcheck.Timeout == 0 {
+		healthcheck.Timeout = 30
+	}
+	if healthcheck.Retries == 0 {
+		healthcheck.Retries = 3
+	}
+	return healthcheck
 }
 
 // effectedImage holdes the docker file that will need to be applied to the container
@@ -261,6 +315,16 @@ func (container *Container) GetConfig() error {
 		targetConfig.Resources.Requests = append(targetConfig.Resources.Requests, "memory=2Gi")
 	}
 
+	// A container can be built on a different base image than the --base-image
+	if len(targetConfig.BaseImage) > 0 {
+		container.BaseImage = targetConfig.BaseImage
+	}
+
+	// The manifests use the same healthcheck intervals as the image
+	if len(targetConfig.Healthcheck.Command) > 0 {
+		targetConfig.Healthcheck = targetConfig.Healthcheck.withDefaults()
+	}
+
 	container.Config = targetConfig
 	container.WriteLog("Container config:", container.Config)
 	return nil
@@ -297,15 +361,54 @@ func (container *Container) Prebuild(progress chan string) error {
 // Note: The Docker api requires BuildArgs to be a string pointer instead of just a string
 func (container *Container) GetBuildArgs() {
 	buildArgs := make(map[string]*string)
-	buildArgs["BASE"] = &container.SoftwareOrder.BaseImage
-	buildArgs["PLATFORM"] = &container.SoftwareOrder.Platform
+	buildArgs["BASE"] = &container.BaseImage
+	buildArgs["PLATFORM"] = &container.Platform.Name
+	buildArgs["PACKAGE_MANAGER"] = &container.Platform.PackageManager
 	buildArgs["PLAYBOOK_SRV"] = &container.SoftwareOrder.CertBaseURL
 	buildArgs["SAS_RPM_REPO_URL"] = &container.SoftwareOrder.MirrorURL
 
+	// The proxy is given with Docker's predefined build arguments so it is not kept in the image.
+	// The builder serves the playbook to the builds, so it is never reached through the proxy.
+	order := container.SoftwareOrder
+	noProxy := order.NoProxy
+	if len(order.HTTPProxy) > 0 || len(order.HTTPSProxy) > 0 {
+		noProxy = strings.TrimPrefix(noProxy+",sas-container-recipes-builder,"+order.BuilderIP, ",")
+	}
+	proxies := map[string]string{
+		"HTTP_PROXY":  order.HTTPProxy,
+		"HTTPS_PROXY": order.HTTPSProxy,
+		"NO_PROXY":    noProxy,
+	}
+	for name, proxy := range proxies {
+		if len(proxy) > 0 {
+			value := proxy
+			buildArgs[name] = &value
+			buildArgs[strings.ToLower(name)] = &value
+		}
+	}
+
+	// The --build-arg arguments, then the build_args of the container's config
+	for _, buildArg := range container.GetExtraBuildArgs() {
+		name, value := splitKeyValue(buildArg, "=")
+		buildArgs[name] = &value
+	}
+
 	container.WriteLog(container.BuildArgs)
 	container.BuildArgs = buildArgs
 }
 
+// GetExtraBuildArgs returns the NAME=value --build-arg arguments with the build_args of the container's config,
+// which replace the arguments with the same name
+func (container *Container) GetExtraBuildArgs() []string {
+	return mergeKeyValues(container.SoftwareOrder.BuildArgs, container.Config.BuildArgs)
+}
+
+// GetLabels returns the name=value --label arguments with the labels of the container's config,
+// which replace the labels with the same name
+func (container *Container) GetLabels() []string {
+	return mergeKeyValues(container.SoftwareOrder.Labels, container.Config.Labels)
+}
+
 // Build interfaces with the Docker client to run an image build
 func (container *Container) Build(progress chan string) error {
 	// Open the context payload created in pre-build so it can be passed to the Docker client
@@ -326,14 +429,41 @@ func (container *Container) Build(progress chan string) error {
 		Remove:      true,
 		ForceRemove: true,
 		ExtraHosts:  extraHosts,
+		Squash:      container.SoftwareOrder.Squash,
+	}
+
+	// The image is first built with the build tooling and each layer so the summary can show the size that was saved.
+	// The second build uses the layer cache of the first.
+	if container.SoftwareOrder.StripBuildTools || container.SoftwareOrder.Squash {
+		referenceOptions := buildOptions
+		referenceOptions.Tags = []string{container.GetReferenceImageName()}
+		referenceOptions.Squash = false
+		if container.SoftwareOrder.StripBuildTools {
+			referenceOptions.Target = "build"
+		}
+		container.WriteLog("----- Starting Docker Build of the Reference Image -----")
+		progress <- "Starting Docker build: " + container.GetReferenceImageName() + " ... "
+		if err := container.buildImage(referenceOptions, progress); err != nil {
+			return err
+		}
+		dockerBuildContext.Close()
+		if dockerBuildContext, err = os.Open(container.DockerContextPath); err != nil {
+			return err
+		}
+		buildOptions.Context = dockerBuildContext
 	}
 
 	// Build the image and get the response
 	container.WriteLog("----- Starting Docker Build -----")
 	progress <- "Starting Docker build: " + container.GetWholeImageName() + " ... "
+	return container.buildImage(buildOptions, progress)
+}
+
+// buildImage sends the context to the Docker client and reads the build's response
+func (container *Container) buildImage(buildOptions types.ImageBuildOptions, progress chan string) error {
 	buildResponseStream, err := container.DockerClient.ImageBuild(
 		container.SoftwareOrder.BuildContext,
-		dockerBuildContext,
+		buildOptions.Context,
 		buildOptions)
 	if err != nil {
 		return err
@@ -342,6 +472,39 @@ func (container *Container) Build(progress chan string) error {
 		container, container.SoftwareOrder.Verbose, progress)
 }
 
+// GetReferenceImageName returns the temporary tag of the image that is built with the build tooling and each layer
+func (container *Container) GetReferenceImageName() string {
+	return container.GetWholeImageName() + "-reference"
+}
+
+// GetImageSize returns the size of a built image from the Docker client ImageList command
+func (container *Container) GetImageSize(image string) (int64, error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("reference", image)
+	imageInfo, err := container.DockerClient.ImageList(container.SoftwareOrder.BuildContext,
+		types.ImageListOptions{Filters: filterArgs})
+	if err != nil {
+		return 0, err
+	}
+	if len(imageInfo) == 0 {
+		return 0, fmt.Errorf("the image %s was not found", image)
+	}
+	return imageInfo[0].Size, nil
+}
+
+// RemoveReferenceImage records the size of the reference image and removes its tag.
+// Its layers are kept in the cache for the next build.
+func (container *Container) RemoveReferenceImage() error {
+	size, err := container.GetImageSize(container.GetReferenceImageName())
+	if err != nil {
+		return err
+	}
+	container.ReferenceSize = size
+	_, err = container.DockerClient.ImageRemove(container.SoftwareOrder.BuildContext,
+		container.GetReferenceImageName(), types.ImageRemoveOptions{PruneChildren: false})
+	return err
+}
+
 // Push the image to the docker registry that's defined in the software order's attributes
 func (container *Container) Push(progress chan string) error {
 	if container.Status != Built {
@@ -349,7 +512,7 @@ func (container *Container) Push(progress chan string) error {
 	}
 
 	// A Docker namespace and registry url is optional in the single container deployment type
-	if container.SoftwareOrder.DeploymentType == "single" &&
+	if container.SoftwareOrder.Deployment.SingleContainer &&
 		(len(container.SoftwareOrder.DockerNamespace) == 0 ||
 			len(container.SoftwareOrder.DockerRegistry) == 0) {
 		return nil
@@ -407,104 +570,96 @@ func readDockerStream(responseStream io.ReadCloser,
 	return nil
 }
 
-const dockerfileFromBase = `# Generated Dockerfile for %s
-FROM %s
-ARG PLATFORM
-ARG PLAYBOOK_SRV
-ENV PLATFORM=$PLATFORM ANSIBLE_CONFIG=/ansible/ansible.cfg ANSIBLE_CONTAINER=true
-RUN mkdir --parents /opt/sas/viya/home/{lib/envesntl,bin}
-RUN if [ "$PLATFORM" = "redhat" ]; then \
-        yum install --assumeyes ansible; \
-		rm -rf /root/.cache /var/cache/yum; \
-		echo -e "minrate=1" >> /etc/yum.conf; \
-		echo -e "timeout=300" >> /etc/yum.conf; \
-    elif [ "$PLATFORM" = "suse" ]; then \
-        zypper install --no-confirm ansible curl && rm -rf /var/cache/zypp; \
-	else \
-		echo -e "Platform $PLATFORM not supported"; \
-		exit 1; \
-    fi
-ADD *.yml *.cfg /ansible/
-ADD roles /ansible/roles
-`
-
-const dockerfileSetupEntrypoint = `# Start a top level process that starts all services
-ENTRYPOINT ["/usr/bin/tini", "--", "/opt/sas/viya/home/bin/%s-entrypoint.sh"]
-`
-
-// Each Ansible role is a RUN layer
-const dockerfileRunLayer = `# %s role
-RUN ansible-playbook -vv /ansible/playbook.yml --extra-vars layer=%s --extra-vars PLAYBOOK_SRV=${PLAYBOOK_SRV}
-`
-
-const dockerfileAddDynamicRole = `# Add the %s specific role
-ADD dynamicRoles /ansible/dynamicRoles
-`
-
-// Add Docker labels to help with finding images
-const dockerfileLabels = `# Define labels
-LABEL sas.recipe="true" \
-      sas.recipe.version="%s" \
-      sas.recipe.image="%s" \
-      sas.layer.%s="true"
-`
-
-// CreateDockerfile creates a Dockerfile by reading the container's configuration
+// CreateDockerfile creates a Dockerfile by executing the Dockerfile templates with the container's configuration
 func (container *Container) CreateDockerfile() (string, error) {
-	// Grab the config and start formatting the Dockerfile
-	dockerfile := fmt.Sprintf(dockerfileFromBase, container.SoftwareOrder.ProjectName+"-"+container.Name, container.BaseImage) + "\n"
+	order := container.SoftwareOrder
+	data := DockerfileData{
+		Name:           container.Name,
+		ImageName:      order.ProjectName + "-" + container.Name,
+		BaseImage:      container.BaseImage,
+		Platform:       container.Platform,
+		DeploymentType: order.DeploymentType,
+		ProjectName:    order.ProjectName,
+		RecipeVersion:  RecipeVersion,
+		Volumes:        container.Config.Volumes,
+		Ports:          container.Config.Ports,
+
+		User:       container.Config.User,
+		Entrypoint: container.Config.Entrypoint,
+		Cmd:        container.Config.Cmd,
+
+		StripBuildTools: order.StripBuildTools,
+	}
+	if len(container.Config.Healthcheck.Command) > 0 {
+		healthcheck := container.Config.Healthcheck
+		data.Healthcheck = &healthcheck
+	}
 
-	// For each role add to the result. Also add the container.Name role (self).
-	dockerfile += "\n# Generated image includes the following Ansible roles, with the "
+	// Each role is a RUN layer. The container.Name role (self) is added from the dynamicRoles directory.
 	for _, role := range container.Config.Roles {
-		if strings.EqualFold(container.Name, role) {
-			dockerfile += fmt.Sprintf(dockerfileAddDynamicRole, role) + "\n"
-		}
-		dockerfile += fmt.Sprintf(dockerfileRunLayer, role, role) + "\n"
+		data.Roles = append(data.Roles, DockerfileRole{Name: role, Dynamic: strings.EqualFold(container.Name, role)})
 	}
 
-	// Add the provided volumes
-	if len(container.Config.Volumes) > 0 {
-		dockerfile += "# Volumes\n"
-	}
-	for _, volume := range container.Config.Volumes {
-		dockerfile += fmt.Sprintf("VOLUME %s\n", volume)
+	// Handle AddOns Dockerfile lines
+	addonLines, err := appendAddonLines(container.Name, "", order.DeploymentType, order.AddOns)
+	if err != nil {
+		return "", err
 	}
+	data.Addons = addonLines
 
-	// Expose the ports that were specified in the config
-	if len(container.Config.Ports) > 0 {
-		dockerfile += "\n# Ports\n"
-	}
-	for _, volume := range container.Config.Ports {
-		dockerfile += fmt.Sprintf("EXPOSE %s\n", volume)
+	// The build arguments that are added to the provided ones are declared so the templates and addons can use them
+	for _, buildArg := range container.GetExtraBuildArgs() {
+		name, _ := splitKeyValue(buildArg, "=")
+		data.BuildArgs = append(data.BuildArgs, name)
 	}
+	sort.Strings(data.BuildArgs)
 
-	// Handle AddOns Dockerfile lines
-	dockerfile, err := appendAddonLines(container.Name, dockerfile, container.SoftwareOrder.DeploymentType, container.SoftwareOrder.AddOns)
+	// The --repositories are added before Ansible is installed
+	data.Repositories, err = RepositoryFiles(order.Repositories)
 	if err != nil {
-		return dockerfile, err
+		return "", err
+	}
+	// A network that needs its own repositories usually cannot reach the public ones either,
+	// so the public repositories of the platform are not added and Ansible must be in the --repositories
+	if len(data.Repositories) > 0 {
+		data.Platform.Repositories = nil
 	}
 
-	dockerfile += "\n" + fmt.Sprintf(dockerfileSetupEntrypoint, container.Name)
-	dockerfile += "\n" + fmt.Sprintf(dockerfileLabels, RecipeVersion, container.Name, container.Name)
-	return dockerfile, nil
+	// Add Docker labels to help with finding images, then the --label arguments and the container's labels
+	data.Labels = []DockerfileLabel{
+		{Name: "sas.recipe", Value: "true"},
+		{Name: "sas.recipe.version", Value: RecipeVersion},
+		{Name: "sas.recipe.image", Value: container.Name},
+		{Name: "sas.layer." + container.Name, Value: "true"},
+	}
+	data.Labels = append(data.Labels, container.GetProvenanceLabels()...)
+	for _, label := range container.GetLabels() {
+		name, value := splitKeyValue(label, "=")
+		data.Labels = append(data.Labels, DockerfileLabel{Name: name, Value: value})
+	}
+	return RenderDockerfile(order.Templates, data)
 }
 
-// readAddonConf reads the yaml file and return the data.
-func readAddonConf(fileName string) (map[string]effectedImage, error) {
-
-	imageData := make(map[string]effectedImage)
-
-	yamlFile, err := ioutil.ReadFile(fileName)
+// LintDockerfile checks the generated Dockerfile and writes the problems to the container's log.
+// With --fail-on-lint-errors an error fails the container's build.
+func (container *Container) LintDockerfile() error {
+	order := container.SoftwareOrder
+	problems, err := LintDockerfile(container.Dockerfile, order.AddonConfigs, order.LintIgnore)
 	if err != nil {
-		return imageData, err
+		return err
 	}
-	err = yaml.Unmarshal(yamlFile, &imageData)
-	if err != nil {
-		return imageData, err
+	container.LintProblems = problems
+	errorLines := []string{}
+	for _, problem := range problems {
+		container.WriteLog("Dockerfile lint", problem.String())
+		if problem.Severity == LintError {
+			errorLines = append(errorLines, problem.String())
+		}
 	}
-
-	return imageData, nil
+	if order.FailOnLintErrors && len(errorLines) > 0 {
+		return fmt.Errorf("The Dockerfile of %s has lint errors:\n%s", container.Name, strings.Join(errorLines, "\n"))
+	}
+	return nil
 }
 
 // appendAddonLines adds any corresponding addon lines to a Dockerfile
@@ -518,20 +673,20 @@ func appendAddonLines(name string, dockerfile string, deploymentType string, add
 		// If we add an addon to a container then set to True and we add sas.recipe.addons=true to the image
 		labelRecipeAddons := false
 		for _, addon := range addons {
-			images, err := readAddonConf(addon + "addon_config.yml")
+			addonConfig, err := LoadAddon(addon)
 			if err != nil {
 				return "", err
 			}
 
 			// If we don't find the image name listed we skip.
-			targetImage, targetFound := images[name]
+			targetImage, targetFound := addonConfig.Images[name]
 			if !targetFound {
 				continue
 			}
 
 			labelRecipeAddons = true
 
-			// Read the addon's Dockerfile and only grab the RUN, ADD, COPY, USER, lines
+			// Read the addon's Dockerfiles and add their instructions
 			dockerfile += "\n# AddOn(s)"
 			dockerfile += "\n# " + addon + "\n"
 
@@ -539,43 +694,33 @@ func appendAddonLines(name string, dockerfile string, deploymentType string, add
 			addonName := filepath.Base(addon)
 
 			dockerfile += "LABEL sas.recipe.addons." + addonName + "=\"true\"\n"
+			if len(addonConfig.Version) > 0 {
+				dockerfile += "LABEL sas.recipe.addons." + addonName + ".version=\"" + addonConfig.Version + "\"\n"
+			}
 
-			// This will need to loop through list.
+			// Merge each instruction that is allowed in an addon Dockerfile.
+			// An ARG that an earlier Dockerfile of the addon declared is only merged once.
+			declaredArgs := []string{}
 			for _, addonDockerfile := range targetImage.Dockerfiles {
-				bytes, _ := ioutil.ReadFile(addon + addonDockerfile)
-				lines := strings.Split(string(bytes), "\n")
-				endsWithSlashRe := regexp.MustCompile("\\\\s*")
-				for index, line := range lines {
-					line = strings.TrimSpace(line)
-					if len(line) == 0 {
-						continue
-					}
-
-					if strings.HasPrefix(line, "RUN ") ||
-						strings.HasPrefix(line, "ADD ") ||
-						strings.HasPrefix(line, "ARG") ||
-						strings.HasPrefix(line, "WORKDIR") ||
-						strings.HasPrefix(line, "USER") ||
-						strings.HasPrefix(line, "COPY ") {
-
-						if strings.Compare(addonName, "ide-jupyter-python3") == 0 && strings.Compare(deploymentType, "single") != 0 && strings.Contains(line, "BASEIMAGE") {
-							dockerfile += "ARG BASEIMAGE=non-single-container\n"
-						} else if strings.Compare(addonName, "ide-jupyter-python3") == 0 && strings.Compare(deploymentType, "single") == 0 && strings.Contains(line, "BASEIMAGE") {
-							dockerfile += line + "\n"
-						} else {
-							dockerfile += line + "\n"
-						}
-
-						// If there's a "\" then it's a multi-line command
-						if strings.Contains(line, "\\") {
-							for _, nextLine := range lines[index+1:] {
-								dockerfile += nextLine + "\n"
-								if !endsWithSlashRe.MatchString(nextLine) {
-									break
-								}
-							}
+				bytes, err := ioutil.ReadFile(addon + addonDockerfile)
+				if err != nil {
+					// Some addons list a Dockerfile they do not ship to only add their label
+					continue
+				}
+				instructions, err := AddonInstructions(addon+addonDockerfile, string(bytes))
+				if err != nil {
+					return "", err
+				}
+				// The addon can set the defaults of its ARG instructions for each deployment type
+				for _, instruction := range instructions {
+					if instruction.Command == "ARG" {
+						argName, _ := splitKeyValue(instruction.Value, "=")
+						if stringInSlice(argName, declaredArgs) {
+							continue
 						}
+						declaredArgs = append(declaredArgs, argName)
 					}
+					dockerfile += addonConfig.ApplyDeploymentArgs(instruction, deploymentType) + "\n"
 				}
 			}
 		}
@@ -630,6 +775,24 @@ func (container *Container) CreateDockerContext() error {
 		return err
 	}
 
+	// The base_image of the container's config can have a different platform than the --base-image
+	container.Platform, err = container.SoftwareOrder.DetectPlatform(container.BaseImage)
+	if err != nil {
+		return err
+	}
+
+	// Add the --repositories, which the Dockerfile copies into the package manager's repository directory
+	repositories, err := RepositoryFiles(container.SoftwareOrder.Repositories)
+	if err != nil {
+		return err
+	}
+	for _, repository := range repositories {
+		err = container.AddFileToContext(filepath.Join(container.SoftwareOrder.Repositories, repository), "repositories/"+repository, []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
 	// Create the self playbook in the root directory
 	err = container.AddFileToContext("util/playbook.yml", "playbook.yml", []byte{})
 	if err != nil {
@@ -649,14 +812,14 @@ func (container *Container) CreateDockerContext() error {
 
 	// Going to copy all the static-roles over. While this will bloat the context, it will make
 	// the begining layers the same for all images and allow for cache re-use and improve build time.
-	staticRolePath := fmt.Sprintf("util/static-roles-%s/", container.SoftwareOrder.DeploymentType)
+	staticRolePath := container.SoftwareOrder.Deployment.StaticRoles
 	files, err := ioutil.ReadDir(staticRolePath)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
 		dep := file.Name()
-		internalRolePath := fmt.Sprintf("util/static-roles-%s/%s/", container.SoftwareOrder.DeploymentType, dep)
+		internalRolePath := staticRolePath + dep + "/"
 
 		// The role exists in the static-roles directory, so copy the entire directory tree
 		err = container.AddDirectoryToContext(internalRolePath, "roles/"+dep+"/", dep)
@@ -685,7 +848,7 @@ func (container *Container) CreateDockerContext() error {
 	// The ansible.cfg file has this location added to the role_path so that it can be found.
 	// This helps with image caching and improving build performance.
 	for _, dep := range container.Config.Roles {
-		internalRolePath := fmt.Sprintf("util/static-roles-%s/%s/", container.SoftwareOrder.DeploymentType, dep)
+		internalRolePath := staticRolePath + dep + "/"
 		if strings.EqualFold(container.Name, dep) {
 			// If the static-role exists then copy that directory structure
 			if _, err := os.Stat(internalRolePath); !os.IsNotExist(err) {
@@ -760,25 +923,20 @@ func (container *Container) CreateDockerContext() error {
 	}
 
 	// Handle the addons -- Each addon has a config file that specifies which container it affects.
-	for _, addon := range container.SoftwareOrder.AddOns {
-		images, err := readAddonConf(addon + "addon_config.yml")
-		if err != nil {
-			return err
-		}
-
+	for _, addon := range container.SoftwareOrder.AddonConfigs {
 		// If we don't find the image name listed we skip.
-		_, targetFound := images[container.Name]
+		_, targetFound := addon.Images[container.Name]
 		if !targetFound {
 			continue
 		}
 
 		// Add the files to the top level of the docker context
-		err = container.AddDirectoryToContext(addon, "", "")
+		err = container.AddAddonToContext(addon)
 		if err != nil {
 			return err
 		}
 
-		container.WriteLog("includes addons", addon)
+		container.WriteLog("includes addons", addon.Path)
 	}
 
 	// Create the Dockerfile and add it to the root of the context
@@ -788,16 +946,19 @@ func (container *Container) CreateDockerContext() error {
 	if err != nil {
 		return err
 	}
+	if err := container.LintDockerfile(); err != nil {
+		return err
+	}
 	container.AddFileToContext("", "Dockerfile", []byte(container.Dockerfile))
 
 	// TODO: workaround for spawner-config requesting items from the casserver-config role
 	//       since the programming image does not need to run ALL the casserver-config tasks
 	//       Later we should de-couple spawner-config from casserver-config
-	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/casserver-config/", "roles/casserver-config/", "casserver-config")
-	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/cloud-config/", "roles/cloud-config/", "cloud-config")
+	container.AddDirectoryToContext(container.SoftwareOrder.Deployment.StaticRoles+"casserver-config/", "roles/casserver-config/", "casserver-config")
+	container.AddDirectoryToContext(container.SoftwareOrder.Deployment.StaticRoles+"cloud-config/", "roles/cloud-config/", "cloud-config")
 
 	// Always include the sas-install role since its used by other roles
-	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/sas-install/", "roles/sas-install/", "sas-install")
+	container.AddDirectoryToContext(container.SoftwareOrder.Deployment.StaticRoles+"sas-install/", "roles/sas-install/", "sas-install")
 
 	return nil
 }
@@ -838,6 +999,10 @@ func (container *Container) AddFileToContext(externalPath string, contextPath st
 	if len(bytes) == 0 {
 		return nil
 	}
+	if container.ContextDigests == nil {
+		container.ContextDigests = make(map[string]string)
+	}
+	container.ContextDigests[contextPath] = sha256Digest(bytes)
 	_, err := container.ContextWriter.Write(bytes)
 	if err != nil {
 		log.Println("Excluding file from context", externalPath, contextPath, err)
@@ -846,6 +1011,12 @@ func (container *Container) AddFileToContext(externalPath string, contextPath st
 	return nil
 }
 
+// skipContextFile reports if a file is left out of the Docker context because it only describes how the image is built
+func skipContextFile(path string) bool {
+	return strings.Contains(path, "Dockerfile") || strings.Contains(path, "addon_config.yml") ||
+		filepath.Base(path) == AddonPackageChecksums
+}
+
 // AddDirectoryToContext adds all item in a directory, and its child items, to the Docker context.
 //
 // externalPath is the path on the build machine
@@ -856,7 +1027,7 @@ func (container *Container) AddDirectoryToContext(externalPath string, contextPa
 	err := filepath.Walk(externalPath, func(path string, info os.FileInfo, err error) error {
 		if info != nil {
 			if !info.IsDir() {
-				if strings.Contains(path, "Dockerfile") || strings.Contains(path, "addon_config.yml") {
+				if skipContextFile(path) {
 					log.Println("Skipping adding file to Docker context: ", path)
 					return nil
 				}
@@ -882,7 +1053,7 @@ func (container *Container) AddDirectoryToContext(externalPath string, contextPa
 			// Always keep intermediate directories. For example,
 			//          Given external=templates/static-roles-<deployment>/sas-java, context=roles/sas-java/
 			//          roles/sas-java/main.yml should be roles/sas-java/tasks/main.yml (keep /tasks/)
-			innerDirectory = strings.Replace(path, "util/static-roles-"+container.SoftwareOrder.DeploymentType+"/"+roleName+"/", "", -1)
+			innerDirectory = strings.Replace(path, container.SoftwareOrder.Deployment.StaticRoles+roleName+"/", "", -1)
 			innerDirectory = strings.Replace(innerDirectory, "/internal/", "", -1)
 			innerDirectory = strings.Replace(innerDirectory, "sas_viya_playbook", "", -1)
 		}
@@ -895,6 +1066,31 @@ func (container *Container) AddDirectoryToContext(externalPath string, contextPa
 	return nil
 }
 
+// AddAddonToContext adds the files of an addon directory to the top level of the Docker context,
+// along with the addon's artifacts that are found in the artifact cache.
+// The addon directory can be anywhere, such as the build directory for an addon package.
+func (container *Container) AddAddonToContext(addon *Addon) error {
+	err := filepath.Walk(addon.Path, func(path string, info os.FileInfo, err error) error {
+		if info == nil || info.IsDir() {
+			return nil
+		}
+		if skipContextFile(path) {
+			log.Println("Skipping adding file to Docker context: ", path)
+			return nil
+		}
+		return container.AddFileToContext(path, strings.TrimPrefix(path, addon.Path), []byte{})
+	})
+	if err != nil {
+		return err
+	}
+	for contextPath, cachePath := range addon.CachedArtifacts {
+		if err := container.AddFileToContext(cachePath, contextPath, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Finish shuts down open file handles and client connections
 func (container *Container) Finish() error {
 	err := container.DockerClient.Close()
@@ -0,0 +1,93 @@
+// deployment.go
+// Loads the deployment types that can be chosen with --type from the
+// deployment-types.yml file, so a new profile such as a CAS only deployment
+// can be added without changing the Go code.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DeploymentTypesPath is the file that defines each deployment type
+const DeploymentTypesPath = "deployment-types.yml"
+
+// DeploymentDefinition describes how a deployment type is built and deployed
+type DeploymentDefinition struct {
+	Description        string   `yaml:"description"`
+	SingleContainer    bool     `yaml:"single_container"`    // Build the programming-only image that is started with docker run
+	StaticRoles        string   `yaml:"static_roles"`        // Directory of the Ansible roles that are added to each image
+	Config             string   `yaml:"config"`              // The config-<deployment-type>.yml file of the containers
+	BuildOnly          []string `yaml:"build_only"`          // The containers that are built unless --build-only is given. Default: every container in the order
+	OrchestrationFlags string   `yaml:"orchestration_flags"` // Added to the sas-orchestration build command that generates the playbook
+	ManifestRole       string   `yaml:"manifest_role"`       // The Ansible role that generates the Kubernetes manifests
+	Ingress            string   `yaml:"ingress"`             // The ingress that the manifest role creates is named <project-name>-<ingress>-ingress
+	Compose            bool     `yaml:"compose"`             // Also generate a docker-compose.yml
+}
+
+// LoadDeploymentTypes reads and checks the deployment type definitions
+func LoadDeploymentTypes(path string) (map[string]DeploymentDefinition, error) {
+	definitions := make(map[string]DeploymentDefinition)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return definitions, fmt.Errorf("Unable to read the deployment types file %s, %s", path, err.Error())
+	}
+	if err := yaml.UnmarshalStrict(content, &definitions); err != nil {
+		return definitions, fmt.Errorf("Unable to parse the deployment types file %s, %s", path, err.Error())
+	}
+
+	for name, definition := range definitions {
+		if definition.SingleContainer {
+			continue
+		}
+		if len(definition.Ingress) == 0 {
+			return definitions, fmt.Errorf("The deployment type %s in %s requires an ingress", name, path)
+		}
+		for field, value := range map[string]string{
+			"static_roles":  definition.StaticRoles,
+			"config":        definition.Config,
+			"manifest_role": definition.ManifestRole,
+		} {
+			if len(value) == 0 {
+				return definitions, fmt.Errorf("The deployment type %s in %s requires a %s", name, path, field)
+			}
+			if _, err := os.Stat(value); err != nil {
+				return definitions, fmt.Errorf("The %s of the deployment type %s in %s cannot be found, %s", field, name, path, err.Error())
+			}
+		}
+		definition.StaticRoles = strings.TrimSuffix(definition.StaticRoles, "/") + "/"
+		definitions[name] = definition
+	}
+	return definitions, nil
+}
+
+// deploymentTypeNames lists the deployment types in order for error messages
+func deploymentTypeNames(definitions map[string]DeploymentDefinition) string {
+	names := []string{}
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,418 @@
+// diff.go
+// Compares the generated Kubernetes manifests and the per-container Dockerfiles
+// of two build directories, so the changes that a new order or a new
+// config-<deployment-type>.yml make to a deployment can be reviewed.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The name of the report that is written to the build directory
+const diffReportName = "manifest-diff.txt"
+
+// Separates the documents of a multi-document YAML file
+var yamlDocumentSeparator = regexp.MustCompile("(?m)^---[ \t]*$")
+
+// The ConfigMap keys that GetConfig fills with the license, the certificates, or the sitedefault.yml
+// of the Software Order. The keys of a ConfigMap are the lower case names of the environment variables.
+var diffMaskedConfigKeys = []string{"sas_license", "sas_client_cert", "sas_ca_cert", "consul_key_value_data_enc", "setinit_text", "setinit_text_enc"}
+
+// ManifestObject is a single Kubernetes object with its fields flattened to
+// paths such as spec.template.spec.containers[name=sas-viya-cas].image
+type ManifestObject struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	File       string
+	Object     map[interface{}]interface{}
+	Fields     map[string]string
+}
+
+// ID is the key that an object is matched on between two builds
+func (object ManifestObject) ID() string {
+	return object.Kind + "/" + object.Name
+}
+
+// loadManifestObjects reads every object from the YAML files in a directory tree, keyed by ID
+func loadManifestObjects(directory string) (map[string]ManifestObject, error) {
+	objects := make(map[string]ManifestObject)
+	documents, err := loadManifestDocuments(directory)
+	for _, object := range documents {
+		object.Fields = make(map[string]string)
+		flattenFields("", object.Object, object.Fields)
+		objects[object.ID()] = object
+	}
+	return objects, err
+}
+
+// loadManifestDocuments reads every object from the YAML files in a directory tree in file order
+func loadManifestDocuments(directory string) ([]ManifestObject, error) {
+	objects := []ManifestObject{}
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (!strings.HasSuffix(path, ".yml") && !strings.HasSuffix(path, ".yaml")) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, document := range yamlDocumentSeparator.Split(string(content), -1) {
+			var parsed map[interface{}]interface{}
+			if err := yaml.Unmarshal([]byte(document), &parsed); err != nil {
+				return fmt.Errorf("Unable to parse %s: %s", path, err.Error())
+			}
+			if len(parsed) == 0 {
+				continue
+			}
+			object := ManifestObject{
+				APIVersion: fmt.Sprintf("%v", parsed["apiVersion"]),
+				Kind:       fmt.Sprintf("%v", parsed["kind"]),
+				File:       strings.TrimPrefix(path, directory),
+				Object:     parsed,
+			}
+			if metadata, ok := parsed["metadata"].(map[interface{}]interface{}); ok {
+				object.Name = fmt.Sprintf("%v", metadata["name"])
+			}
+			objects = append(objects, object)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return objects, nil
+	}
+	return objects, err
+}
+
+// flattenFields adds the value of every leaf of a YAML document to fields, keyed by its path.
+// List items that have a name are keyed by the name instead of their position
+// so adding an environment variable does not show every following item as changed.
+func flattenFields(path string, value interface{}, fields map[string]string) {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		if len(typed) == 0 {
+			fields[path] = "{}"
+		}
+		for key, item := range typed {
+			childPath := fmt.Sprintf("%v", key)
+			if len(path) > 0 {
+				childPath = path + "." + childPath
+			}
+			flattenFields(childPath, item, fields)
+		}
+	case []interface{}:
+		if len(typed) == 0 {
+			fields[path] = "[]"
+		}
+		for index, item := range typed {
+			flattenFields(path+fieldPathElement(index, item), item, fields)
+		}
+	default:
+		fields[path] = fmt.Sprintf("%v", value)
+	}
+}
+
+// fieldPathElement is the path element of a list item: [name=<name>] if the item has a name, otherwise [<index>]
+func fieldPathElement(index int, item interface{}) string {
+	if mapping, ok := item.(map[interface{}]interface{}); ok {
+		if name, found := mapping["name"]; found {
+			return fmt.Sprintf("[name=%v]", name)
+		}
+	}
+	return fmt.Sprintf("[%d]", index)
+}
+
+// loadDockerfiles reads the Dockerfile of each container from the build contexts in a build directory
+func loadDockerfiles(buildPath string) (map[string]string, error) {
+	dockerfiles := make(map[string]string)
+	directories, err := ioutil.ReadDir(buildPath)
+	if err != nil {
+		return dockerfiles, err
+	}
+	for _, directory := range directories {
+		contextPath := filepath.Join(buildPath, directory.Name(), "build_context.tar")
+		if !directory.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(contextPath); os.IsNotExist(err) {
+			continue
+		}
+		contextFile, err := os.Open(contextPath)
+		if err != nil {
+			return dockerfiles, err
+		}
+		reader := tar.NewReader(contextFile)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				contextFile.Close()
+				return dockerfiles, fmt.Errorf("Unable to read %s: %s", contextPath, err.Error())
+			}
+			if header.Name == "Dockerfile" {
+				content, err := ioutil.ReadAll(reader)
+				if err != nil {
+					contextFile.Close()
+					return dockerfiles, err
+				}
+				dockerfiles[directory.Name()] = string(content)
+				break
+			}
+		}
+		contextFile.Close()
+	}
+	return dockerfiles, nil
+}
+
+// diffLines returns the lines that were removed from and added to a text,
+// based on the longest common subsequence of the two texts' lines
+func diffLines(previous string, current string) []string {
+	a := strings.Split(strings.TrimRight(previous, "\n"), "\n")
+	b := strings.Split(strings.TrimRight(current, "\n"), "\n")
+
+	// lengths[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	changes := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lengths[i+1][j] >= lengths[i][j+1]):
+			changes = append(changes, "- "+a[i])
+			i++
+		default:
+			changes = append(changes, "+ "+b[j])
+			j++
+		}
+	}
+	return changes
+}
+
+// sortedKeys returns the keys of a set of names in order
+func sortedKeys(items map[string]bool) []string {
+	keys := []string{}
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DiffManifests reports the changes to the Kubernetes objects between two manifest directories
+func DiffManifests(previousPath string, currentPath string) ([]string, error) {
+	previous, err := loadManifestObjects(previousPath)
+	if err != nil {
+		return nil, err
+	}
+	current, err := loadManifestObjects(currentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for id := range previous {
+		ids[id] = true
+	}
+	for id := range current {
+		ids[id] = true
+	}
+
+	report := []string{}
+	for _, id := range sortedKeys(ids) {
+		before, existed := previous[id]
+		after, exists := current[id]
+		if !existed {
+			report = append(report, fmt.Sprintf("  + %s (%s)", id, after.File))
+			continue
+		}
+		if !exists {
+			report = append(report, fmt.Sprintf("  - %s (%s)", id, before.File))
+			continue
+		}
+
+		paths := make(map[string]bool)
+		for path := range before.Fields {
+			paths[path] = true
+		}
+		for path := range after.Fields {
+			paths[path] = true
+		}
+		changes := []string{}
+		for _, path := range sortedKeys(paths) {
+			oldValue, hadValue := before.Fields[path]
+			newValue, hasValue := after.Fields[path]
+			if hadValue && hasValue && oldValue == newValue {
+				continue
+			}
+
+			// Do not print the license or other secret values to the report, only that they changed
+			if isMaskedField(after.Kind, path) {
+				switch {
+				case !hadValue:
+					changes = append(changes, fmt.Sprintf("      + %s", path))
+				case !hasValue:
+					changes = append(changes, fmt.Sprintf("      - %s", path))
+				default:
+					changes = append(changes, fmt.Sprintf("      ~ %s: changed", path))
+				}
+				continue
+			}
+			switch {
+			case !hadValue:
+				changes = append(changes, fmt.Sprintf("      + %s: %s", path, newValue))
+			case !hasValue:
+				changes = append(changes, fmt.Sprintf("      - %s: %s", path, oldValue))
+			default:
+				changes = append(changes, fmt.Sprintf("      ~ %s: %s -> %s", path, oldValue, newValue))
+			}
+		}
+		if len(changes) > 0 {
+			report = append(report, fmt.Sprintf("  ~ %s (%s)", id, after.File))
+			report = append(report, changes...)
+		}
+	}
+	return report, nil
+}
+
+// isMaskedField reports if the value of a field can contain the license or another secret
+func isMaskedField(kind string, path string) bool {
+	if kind == "Secret" {
+		return strings.HasPrefix(path, "data.") || strings.HasPrefix(path, "stringData.")
+	}
+	if kind == "ConfigMap" && strings.HasPrefix(path, "data.") {
+		return stringInSlice(strings.ToLower(strings.TrimPrefix(path, "data.")), diffMaskedConfigKeys)
+	}
+	return false
+}
+
+// DiffDockerfiles reports the changes to each container's Dockerfile between two build directories
+func DiffDockerfiles(previousPath string, currentPath string) ([]string, error) {
+	previous, err := loadDockerfiles(previousPath)
+	if err != nil {
+		return nil, err
+	}
+	current, err := loadDockerfiles(currentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range previous {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+
+	report := []string{}
+	for _, name := range sortedKeys(names) {
+		before, existed := previous[name]
+		after, exists := current[name]
+		if !existed {
+			report = append(report, "  + "+name)
+			continue
+		}
+		if !exists {
+			report = append(report, "  - "+name)
+			continue
+		}
+		changes := diffLines(before, after)
+		if len(changes) > 0 {
+			report = append(report, "  ~ "+name)
+			for _, change := range changes {
+				report = append(report, "      "+change)
+			}
+		}
+	}
+	return report, nil
+}
+
+// ShowDiff prints and saves a report of what changed between the --diff-against build and this one
+func (order *SoftwareOrder) ShowDiff() error {
+	current, err := order.LoadManifestInputs()
+	if err != nil {
+		return err
+	}
+	previousOrder := *order
+	previousOrder.BuildPath = strings.TrimSuffix(order.DiffAgainst, "/") + "/"
+	previous, err := previousOrder.LoadManifestInputs()
+	if err != nil {
+		return err
+	}
+
+	manifestChanges, err := DiffManifests(previous.ManifestPath()+"kubernetes/", current.ManifestPath()+"kubernetes/")
+	if err != nil {
+		return err
+	}
+	dockerfileChanges, err := DiffDockerfiles(previous.BuildPath, current.BuildPath)
+	if err != nil {
+		return err
+	}
+
+	report := []string{fmt.Sprintf("Changes from %s to %s", previous.BuildPath, current.BuildPath), ""}
+	report = append(report, "Kubernetes manifests:")
+	if len(manifestChanges) == 0 {
+		manifestChanges = []string{"  No changes"}
+	}
+	report = append(report, manifestChanges...)
+	report = append(report, "", "Dockerfiles:")
+	if len(dockerfileChanges) == 0 {
+		dockerfileChanges = []string{"  No changes"}
+	}
+	report = append(report, dockerfileChanges...)
+	content := strings.Join(report, "\n") + "\n"
+
+	if err := ioutil.WriteFile(order.BuildPath+diffReportName, []byte(content), 0644); err != nil {
+		return err
+	}
+	fmt.Println("\n" + content)
+	order.WriteLog(false, content)
+	return nil
+}
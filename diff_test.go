@@ -0,0 +1,45 @@
+// diff_test.go
+// Tests that the report of --diff-against does not show the license or other secrets.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import "testing"
+
+// The values of Secrets and of the ConfigMap keys that GetConfig fills from the Software Order are masked
+func TestIsMaskedField(t *testing.T) {
+	tests := []struct {
+		kind     string
+		path     string
+		expected bool
+	}{
+		{"Secret", "data.setinit_text_enc", true},
+		{"Secret", "stringData.password", true},
+		{"Secret", "metadata.name", false},
+		{"ConfigMap", "data.sas_license", true},
+		{"ConfigMap", "data.SAS_CLIENT_CERT", true},
+		{"ConfigMap", "data.sas_ca_cert", true},
+		{"ConfigMap", "data.consul_key_value_data_enc", true},
+		{"ConfigMap", "data.sas_debug", false},
+		{"Deployment", "data.sas_license", false},
+	}
+	for _, test := range tests {
+		if masked := isMaskedField(test.kind, test.path); masked != test.expected {
+			t.Errorf("%s %s: expected %t, got %t", test.kind, test.path, test.expected, masked)
+		}
+	}
+}
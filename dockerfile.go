@@ -0,0 +1,285 @@
+// dockerfile.go
+// Parses Dockerfiles into instructions so the addon Dockerfiles can be merged
+// into each image's Dockerfile instruction by instruction, including the
+// multi-line, JSON form, and heredoc instructions.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The instructions of the Dockerfile reference https://docs.docker.com/engine/reference/builder/
+var dockerfileCommands = []string{
+	"ADD", "ARG", "CMD", "COPY", "ENTRYPOINT", "ENV", "EXPOSE", "FROM", "HEALTHCHECK",
+	"LABEL", "MAINTAINER", "ONBUILD", "RUN", "SHELL", "STOPSIGNAL", "USER", "VOLUME", "WORKDIR",
+}
+
+// Instructions that accept options such as --chown=sas:sas before their arguments
+var dockerfileFlagCommands = []string{"ADD", "COPY", "FROM", "HEALTHCHECK", "RUN"}
+
+// Instructions that can contain heredocs such as RUN <<EOF
+var dockerfileHeredocCommands = []string{"ADD", "COPY", "RUN"}
+
+var (
+	// A parser directive such as "# escape=`", which is only read at the top of a Dockerfile
+	dockerfileDirectiveRegex = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(\S+)\s*$`)
+
+	// The start of a heredoc such as <<EOF, <<-EOF, or <<"EOF" at the start of a word.
+	// A shift such as $((1<<N)) and a here-string such as <<<hello are not heredocs.
+	dockerfileHeredocRegex = regexp.MustCompile(`(^|\s)<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+)
+
+// DockerfileHeredoc is the content of a heredoc in a RUN, COPY, or ADD instruction
+type DockerfileHeredoc struct {
+	Name    string
+	Content string
+}
+
+// DockerfileInstruction is a single instruction of a Dockerfile
+type DockerfileInstruction struct {
+	Command  string   // The instruction in upper case, such as RUN
+	Flags    []string // Options before the arguments, such as --chown=sas:sas
+	Value    string   // The arguments with the line continuations joined
+	JSON     []string // The arguments of the JSON form, such as CMD ["/usr/bin/tini", "--"]
+	IsJSON   bool
+	Heredocs []DockerfileHeredoc
+	Original string // The instruction as it is written, including its continuation and heredoc lines
+	Line     int    // The line number the instruction starts on
+}
+
+// Dockerfile is a parsed Dockerfile
+type Dockerfile struct {
+	Escape       string // The line continuation character, \ or `
+	Syntax       string // The "# syntax=" directive, which BuildKit needs to build heredocs
+	Instructions []DockerfileInstruction
+}
+
+// splitFirstWord splits a line into its first word and the rest of the line
+func splitFirstWord(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	end := strings.IndexAny(line, " \t")
+	if end < 0 {
+		return line, ""
+	}
+	return line[:end], strings.TrimSpace(line[end:])
+}
+
+// splitDockerfileWords splits the arguments of an instruction such as ARG or ENV at the spaces that
+// are not quoted or escaped with a backslash. Each word is returned as it is written, with its quotes and escapes.
+func splitDockerfileWords(value string) []string {
+	words := []string{}
+	word := ""
+	quote := rune(0)
+	escaped := false
+	for _, character := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case character == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if character == quote {
+				quote = 0
+			}
+		case character == '"' || character == '\'':
+			quote = character
+		case character == ' ' || character == '\t':
+			if len(word) > 0 {
+				words = append(words, word)
+			}
+			word = ""
+			continue
+		}
+		word += string(character)
+	}
+	if len(word) > 0 {
+		words = append(words, word)
+	}
+	return words
+}
+
+// ParseDockerfile splits a Dockerfile into its instructions
+func ParseDockerfile(content string) (*Dockerfile, error) {
+	dockerfile := &Dockerfile{Escape: "\\"}
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+
+	// Parser directives must come before any comment, empty line, or instruction
+	index := 0
+	for ; index < len(lines); index++ {
+		match := dockerfileDirectiveRegex.FindStringSubmatch(lines[index])
+		if match == nil {
+			break
+		}
+		if strings.ToLower(match[1]) == "escape" {
+			if match[2] != "\\" && match[2] != "`" {
+				return nil, fmt.Errorf("line %d: invalid escape directive '%s': choose between \\ or `", index+1, match[2])
+			}
+			dockerfile.Escape = match[2]
+		} else if strings.ToLower(match[1]) == "syntax" {
+			dockerfile.Syntax = match[2]
+		}
+	}
+
+	for index < len(lines) {
+		trimmed := strings.TrimSpace(lines[index])
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			index++
+			continue
+		}
+
+		// Join the continuation lines. Comments and empty lines within an instruction are skipped.
+		start := index
+		original := []string{lines[index]}
+		joined := ""
+		line := strings.TrimRight(lines[index], " \t")
+		index++
+		for strings.HasSuffix(line, dockerfile.Escape) {
+			joined += strings.TrimSuffix(line, dockerfile.Escape)
+			line = ""
+			for index < len(lines) {
+				next := strings.TrimSpace(lines[index])
+				original = append(original, lines[index])
+				index++
+				if next != "" && !strings.HasPrefix(next, "#") {
+					line = strings.TrimRight(lines[index-1], " \t")
+					break
+				}
+			}
+			if index >= len(lines) && line == "" {
+				break
+			}
+		}
+		joined += line
+
+		instruction := DockerfileInstruction{Line: start + 1}
+		command, value := splitFirstWord(joined)
+		instruction.Command = strings.ToUpper(command)
+		if !stringInSlice(instruction.Command, dockerfileCommands) {
+			return nil, fmt.Errorf("line %d: unknown instruction %s", start+1, command)
+		}
+		if stringInSlice(instruction.Command, dockerfileFlagCommands) {
+			for strings.HasPrefix(value, "--") {
+				var flag string
+				flag, value = splitFirstWord(value)
+				instruction.Flags = append(instruction.Flags, flag)
+			}
+		}
+		instruction.Value = value
+
+		if strings.HasPrefix(value, "[") {
+			if err := json.Unmarshal([]byte(value), &instruction.JSON); err == nil {
+				instruction.IsJSON = true
+			}
+		}
+
+		// The heredoc content follows the instruction, in the order the heredocs are named.
+		// Only BuildKit builds heredocs, so without a syntax directive the << is left to the shell.
+		if len(dockerfile.Syntax) > 0 && stringInSlice(instruction.Command, dockerfileHeredocCommands) {
+			for _, match := range dockerfileHeredocRegex.FindAllStringSubmatch(value, -1) {
+				heredoc := DockerfileHeredoc{Name: match[4]}
+				body := []string{}
+				terminated := false
+				for index < len(lines) {
+					original = append(original, lines[index])
+					bodyLine := lines[index]
+					index++
+					if match[2] == "-" {
+						bodyLine = strings.TrimLeft(bodyLine, "\t")
+					}
+					if bodyLine == heredoc.Name {
+						terminated = true
+						break
+					}
+					body = append(body, bodyLine)
+				}
+				if !terminated {
+					return nil, fmt.Errorf("line %d: the heredoc %s is not terminated", start+1, heredoc.Name)
+				}
+				heredoc.Content = strings.Join(body, "\n")
+				instruction.Heredocs = append(instruction.Heredocs, heredoc)
+			}
+		}
+
+		// Trailing comments and empty lines belong to the next instruction
+		for len(original) > 1 {
+			last := strings.TrimSpace(original[len(original)-1])
+			if last != "" && !strings.HasPrefix(last, "#") {
+				break
+			}
+			original = original[:len(original)-1]
+		}
+		instruction.Original = strings.Join(original, "\n")
+		dockerfile.Instructions = append(dockerfile.Instructions, instruction)
+	}
+	return dockerfile, nil
+}
+
+// The instructions of an addon Dockerfile that are added to an image's Dockerfile.
+// The addon's FROM is replaced by the image being built. Any other instruction is an error
+// instead of being dropped, with the reason it cannot be added.
+var addonAllowedCommands = []string{
+	"ADD", "ARG", "COPY", "ENV", "EXPOSE", "HEALTHCHECK", "LABEL", "RUN", "USER", "VOLUME", "WORKDIR",
+}
+var addonDeniedCommands = map[string]string{
+	"CMD":        "it would replace the command that starts the SAS Viya services",
+	"ENTRYPOINT": "it would replace the entrypoint that starts the SAS Viya services",
+	"MAINTAINER": "it is deprecated, use a LABEL instead",
+	"ONBUILD":    "its instructions would run in images that are built from this image instead",
+	"SHELL":      "it would change the shell of the instructions of the images and the other addons",
+	"STOPSIGNAL": "the SAS Viya services rely on the default stop signal",
+}
+
+// AddonInstructions returns the instructions of an addon Dockerfile that are merged into an image's Dockerfile.
+// Every instruction that cannot be merged is reported in the error.
+func AddonInstructions(path string, content string) ([]DockerfileInstruction, error) {
+	dockerfile, err := ParseDockerfile(content)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %s", path, err.Error())
+	}
+
+	merged := []DockerfileInstruction{}
+	problems := []string{}
+	fromCount := 0
+	for _, instruction := range dockerfile.Instructions {
+		switch {
+		case instruction.Command == "FROM":
+			fromCount++
+			if fromCount > 1 {
+				problems = append(problems, fmt.Sprintf("%s:%d: FROM cannot be used more than once: multi-stage addon Dockerfiles are not supported",
+					path, instruction.Line))
+			}
+		case len(instruction.Heredocs) > 0:
+			problems = append(problems, fmt.Sprintf("%s:%d: heredocs cannot be used in an addon Dockerfile: the images are built without BuildKit",
+				path, instruction.Line))
+		case stringInSlice(instruction.Command, addonAllowedCommands):
+			merged = append(merged, instruction)
+		default:
+			problems = append(problems, fmt.Sprintf("%s:%d: %s cannot be used in an addon Dockerfile: %s",
+				path, instruction.Line, instruction.Command, addonDeniedCommands[instruction.Command]))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "\n"))
+	}
+	return merged, nil
+}
@@ -0,0 +1,84 @@
+// dockerfile_test.go
+// Tests the parsing of the heredocs of Dockerfiles.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A << that does not start a heredoc must be left to the shell
+func TestParseDockerfileShellRedirections(t *testing.T) {
+	tests := map[string]string{
+		"arithmetic shift": "FROM centos:7\nRUN echo $((1<<N))\nUSER sas\n",
+		"here-string":      "FROM centos:7\nRUN cat <<<hello\nUSER sas\n",
+		"no syntax":        "FROM centos:7\nRUN cat <<EOF > /tmp/file\nUSER sas\n",
+	}
+	for name, content := range tests {
+		dockerfile, err := ParseDockerfile(content)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if len(dockerfile.Instructions) != 3 {
+			t.Errorf("%s: expected 3 instructions, got %d", name, len(dockerfile.Instructions))
+			continue
+		}
+		if len(dockerfile.Instructions[1].Heredocs) != 0 {
+			t.Errorf("%s: expected no heredocs, got %v", name, dockerfile.Instructions[1].Heredocs)
+		}
+	}
+}
+
+// The arguments are split at the spaces that are not quoted or escaped, and each word is kept as it is written
+func TestSplitDockerfileWords(t *testing.T) {
+	tests := map[string][]string{
+		`A=1 B=2`:               {`A=1`, `B=2`},
+		`OPTS="-a -b" MODE=x`:   {`OPTS="-a -b"`, `MODE=x`},
+		`OPTS='-a "b c"'  MODE`: {`OPTS='-a "b c"'`, `MODE`},
+		`PATH=a\ b C=\"d e`:     {`PATH=a\ b`, `C=\"d`, `e`},
+		`NAME`:                  {`NAME`},
+		``:                      {},
+	}
+	for value, expected := range tests {
+		words := splitDockerfileWords(value)
+		if !reflect.DeepEqual(words, expected) {
+			t.Errorf("%s: expected %q, got %q", value, expected, words)
+		}
+	}
+}
+
+// A heredoc is read when the Dockerfile has a syntax directive
+func TestParseDockerfileHeredoc(t *testing.T) {
+	content := "# syntax=docker/dockerfile:1\nFROM centos:7\nRUN <<-EOF bash\n\techo $((1<<2))\n\tEOF\nUSER sas\n"
+	dockerfile, err := ParseDockerfile(content)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(dockerfile.Instructions) != 3 {
+		t.Fatalf("expected 3 instructions, got %d", len(dockerfile.Instructions))
+	}
+	heredocs := dockerfile.Instructions[1].Heredocs
+	if len(heredocs) != 1 || heredocs[0].Name != "EOF" || heredocs[0].Content != "echo $((1<<2))" {
+		t.Errorf("unexpected heredocs %v", heredocs)
+	}
+	if _, err := AddonInstructions("Dockerfile", content); err == nil {
+		t.Errorf("expected the heredoc to be refused in an addon Dockerfile")
+	}
+}
@@ -0,0 +1,274 @@
+// helm.go
+// Creates a Helm chart from the same service definitions that are used
+// to generate the raw Kubernetes manifests, so a deployment can be
+// upgraded with `helm upgrade` instead of re-applying directories.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// HelmTemplatesPath holds the static chart templates that are copied into every chart
+const HelmTemplatesPath = "util/helm/templates"
+
+// HelmChart is the content of the chart's Chart.yaml
+type HelmChart struct {
+	APIVersion  string `yaml:"apiVersion"`
+	Name        string `yaml:"name"`
+	Version     string `yaml:"version"`
+	AppVersion  string `yaml:"appVersion"`
+	Description string `yaml:"description"`
+}
+
+// HelmValues is the content of the chart's values.yaml
+type HelmValues struct {
+	ProjectName string `yaml:"projectName"`
+	Image       struct {
+		Registry   string `yaml:"registry"`
+		Namespace  string `yaml:"namespace"`
+		Tag        string `yaml:"tag"`
+		PullPolicy string `yaml:"pullPolicy"`
+	} `yaml:"image"`
+	Ingress struct {
+		Enabled bool              `yaml:"enabled"`
+		Name    string            `yaml:"name"`
+		Rules   []HelmIngressRule `yaml:"rules"`
+	} `yaml:"ingress"`
+	SecureConsul    bool                   `yaml:"secureConsul"`
+	Subdomain       bool                   `yaml:"subdomain"`       // Create the headless <project>-subdomain service
+	ConsulClientEnv map[string]string      `yaml:"consulClientEnv"` // Environment variable to consul configmap key
+	Services        map[string]HelmService `yaml:"services"`
+}
+
+// HelmIngressRule routes a host to one of the chart's services
+type HelmIngressRule struct {
+	Host        string `yaml:"host"`
+	Service     string `yaml:"service"`
+	ServicePort int    `yaml:"servicePort"`
+}
+
+// HelmService holds the values of a single service in values.yaml
+type HelmService struct {
+	Enabled      bool   `yaml:"enabled"`
+	Name         string `yaml:"name"`
+	Kind         string `yaml:"kind"`
+	Replicas     int    `yaml:"replicas"`
+	Expose       bool   `yaml:"expose"`
+	ConsulClient bool   `yaml:"consulClient"`
+	Image        struct {
+		Repository string `yaml:"repository"`
+		Tag        string `yaml:"tag"`
+	} `yaml:"image"`
+	Ports             []int                        `yaml:"ports"`
+	Env               map[string]string            `yaml:"env"`
+	Secrets           map[string]string            `yaml:"secrets"`
+	Resources         map[string]map[string]string `yaml:"resources"`
+	Volumes           []HelmVolume                 `yaml:"volumes"`
+	ExtraVolumes      []interface{}                `yaml:"extraVolumes"`
+	ExtraVolumeMounts []interface{}                `yaml:"extraVolumeMounts"`
+	ConfigFiles       []HelmFile                   `yaml:"configFiles,omitempty"`
+	SecretFiles       []HelmFile                   `yaml:"secretFiles,omitempty"`
+	LivenessProbe     *ManifestProbe               `yaml:"livenessProbe,omitempty"`
+	ReadinessProbe    *ManifestProbe               `yaml:"readinessProbe,omitempty"`
+	SecurityContext   *ManifestSecurityContext     `yaml:"securityContext,omitempty"`
+}
+
+// HelmVolume is an emptyDir volume that is mounted into the service's container
+type HelmVolume struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+}
+
+// HelmFile is a file of the chart's files/<service>/ directory that is mounted into the service's container
+// from a ConfigMap, or from a Secret
+type HelmFile struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	Mode      int    `yaml:"mode,omitempty"`
+}
+
+// Environment variables that every microservice reads from the consul configmap.
+// This mirrors util/static-roles-full/manifests/templates/microservice_k8s.j2
+var helmConsulClientEnv = map[string]string{
+	"SECURE_CONSUL":            "secure_consul",
+	"DISABLE_CONSUL_HTTP_PORT": "disable_consul_http_port",
+	"SAS_ANCHORS_DIR":          "sas_anchors_dir",
+	"VAULT_TOKEN_DIR":          "vault_token_dir",
+	"SASSERVICES_CONFIGMAP":    "sas_services_configmap",
+	"CONSUL_DATACENTER_NAME":   "consul_datacenter_name",
+}
+
+// GetHelmValues converts the manifest inputs into the chart's values
+func GetHelmValues(inputs *ManifestInputs) (HelmValues, error) {
+	values := HelmValues{}
+	values.ProjectName = inputs.ProjectName()
+	values.Image.Registry, values.Image.Namespace = inputs.Registry()
+	values.Image.Tag = inputs.Tag
+	values.Image.PullPolicy = "Always"
+	values.SecureConsul = strings.ToLower(inputs.Var("SECURE_CONSUL", "false")) == "true"
+	values.Services = make(map[string]HelmService)
+
+	_, hasConsul := inputs.Settings.Services["consul"]
+	values.Subdomain = hasConsul
+	if hasConsul {
+		values.ConsulClientEnv = helmConsulClientEnv
+	}
+
+	// Same ingress names and rules as util/static-roles-<type>/manifests/templates/k8s_ingress.j2
+	values.Ingress.Enabled = true
+	values.Ingress.Name = inputs.ProjectName() + "-" + inputs.Ingress + "-ingress"
+	values.Ingress.Rules = []HelmIngressRule{
+		{Host: inputs.IngressHost(), Service: "httpproxy", ServicePort: 80},
+	}
+	if _, hasESP := inputs.Settings.Services["espserver"]; hasESP {
+		values.Ingress.Rules = append(values.Ingress.Rules, HelmIngressRule{
+			Host:        fmt.Sprintf("%s-esp-design.%s.%s", inputs.ProjectName(), inputs.Namespace(), inputs.Var("SAS_K8S_INGRESS_DOMAIN", "company.com")),
+			Service:     "espserver",
+			ServicePort: 31415,
+		})
+	}
+
+	for _, name := range inputs.ServiceNames() {
+		service := HelmService{
+			Enabled:  true,
+			Name:     inputs.ResourceName(name),
+			Kind:     "Deployment",
+			Replicas: 1,
+			Expose:   IsExposed(name),
+		}
+		if IsStateful(name) {
+			service.Kind = "StatefulSet"
+		}
+		service.ConsulClient = hasConsul && !IsStateful(name)
+		service.Image.Repository = inputs.ProjectName() + "-" + name
+
+		for _, port := range inputs.Ports(name) {
+			portNumber, err := strconv.Atoi(port)
+			if err != nil {
+				return values, fmt.Errorf("Invalid port '%s' for %s: %s", port, name, err.Error())
+			}
+			service.Ports = append(service.Ports, portNumber)
+		}
+
+		// The configmap template writes the same special cases for consul and espserver
+		service.Env = make(map[string]string)
+		for _, item := range inputs.Environment(name) {
+			key, value := item[0], item[1]
+			if strings.Contains(key, "DISABLE_CONSUL_HTTP_PORT") && !values.SecureConsul {
+				value = "false"
+			}
+			if name == "espserver" && strings.Contains(key, "ESPENV") {
+				value = fmt.Sprintf("%s=\"%s\"", key, value)
+			}
+			service.Env[key] = value
+		}
+		service.Secrets = make(map[string]string)
+		for _, item := range inputs.Secrets(name) {
+			service.Secrets[item[0]] = item[1]
+		}
+		service.Resources = inputs.Resources(name)
+		service.LivenessProbe = inputs.LivenessProbe(name)
+		service.ReadinessProbe = inputs.Probe(name)
+		service.SecurityContext = inputs.SecurityContext(name)
+		for _, item := range inputs.Volumes(name) {
+			service.Volumes = append(service.Volumes, HelmVolume{Name: item[0], MountPath: item[1]})
+		}
+		for _, file := range inputs.Files(name) {
+			helmFile := HelmFile{Name: file.Name, MountPath: file.MountPath, Mode: file.Mode}
+			if file.Secret {
+				service.SecretFiles = append(service.SecretFiles, helmFile)
+			} else {
+				service.ConfigFiles = append(service.ConfigFiles, helmFile)
+			}
+		}
+
+		var err error
+		service.ExtraVolumes, err = inputs.CustomYAML(inputs.CustomVolumes, name)
+		if err != nil {
+			return values, err
+		}
+		service.ExtraVolumeMounts, err = inputs.CustomYAML(inputs.CustomVolumeMounts, name)
+		if err != nil {
+			return values, err
+		}
+		values.Services[name] = service
+	}
+	return values, nil
+}
+
+// GenerateHelmChart writes a chart to <build>/<SAS_MANIFEST_DIR>/helm/<project_name>/
+func (order *SoftwareOrder) GenerateHelmChart() error {
+	order.WriteLog(true, "Creating Helm chart ...")
+	inputs, err := order.LoadManifestInputs()
+	if err != nil {
+		return err
+	}
+
+	chartPath := inputs.ManifestPath() + "helm/" + inputs.ProjectName() + "/"
+	if err := os.RemoveAll(chartPath); err != nil {
+		return err
+	}
+	if err := copyDirectory(HelmTemplatesPath, chartPath+"templates"); err != nil {
+		return fmt.Errorf("Unable to copy the Helm templates from %s, %s", HelmTemplatesPath, err.Error())
+	}
+
+	chart := HelmChart{
+		APIVersion:  "v1",
+		Name:        inputs.ProjectName(),
+		Version:     RecipeVersion,
+		AppVersion:  inputs.Tag,
+		Description: fmt.Sprintf("SAS Viya %s deployment created by SAS Container Recipes", inputs.DeploymentType),
+	}
+	chartContent, err := yaml.Marshal(chart)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(chartPath+"Chart.yaml", chartContent, 0644); err != nil {
+		return err
+	}
+
+	values, err := GetHelmValues(inputs)
+	if err != nil {
+		return err
+	}
+	// The templates read the mounted files with .Files.Get, which only reads files inside the chart
+	for _, name := range inputs.ServiceNames() {
+		if err := inputs.CopyFiles(name, chartPath+"files"); err != nil {
+			return err
+		}
+	}
+	valuesContent, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	header := "# Generated by SAS Container Recipes. Override these values with `helm upgrade --values`.\n" +
+		"# NOTE: the services' secrets contain the license from the Software Order Email.\n"
+	if err := ioutil.WriteFile(chartPath+"values.yaml", append([]byte(header), valuesContent...), 0644); err != nil {
+		return err
+	}
+
+	order.WriteLog(true, "Finished creating Helm chart "+chartPath)
+	return nil
+}
@@ -0,0 +1,262 @@
+// kustomize.go
+// Creates a kustomize layout from the generated Kubernetes manifests:
+// a base that holds the generated objects and one overlay stub per
+// environment so that environment differences can be kept in git.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The generated manifest directories that make up the kustomize base, in the order they are applied.
+// The namespace is left out since each overlay creates its own.
+var kustomizeBaseDirectories = []string{"accounts", "configmaps", "secrets", "services", "deployments", "ingress"}
+
+// Kustomization is the content of a kustomization.yaml file
+type Kustomization struct {
+	APIVersion            string                    `yaml:"apiVersion"`
+	Kind                  string                    `yaml:"kind"`
+	Namespace             string                    `yaml:"namespace,omitempty"`
+	Resources             []string                  `yaml:"resources,omitempty"`
+	Images                []KustomizeImage          `yaml:"images,omitempty"`
+	PatchesStrategicMerge []string                  `yaml:"patchesStrategicMerge,omitempty"`
+	PatchesJSON6902       []KustomizeJSON6902Target `yaml:"patchesJson6902,omitempty"`
+}
+
+// KustomizeImage replaces the tag of an image in every object of the base
+type KustomizeImage struct {
+	Name   string `yaml:"name"`
+	NewTag string `yaml:"newTag"`
+}
+
+// KustomizeJSON6902Target applies a JSON patch file to a single object
+type KustomizeJSON6902Target struct {
+	Target struct {
+		Group   string `yaml:"group,omitempty"`
+		Version string `yaml:"version"`
+		Kind    string `yaml:"kind"`
+		Name    string `yaml:"name"`
+	} `yaml:"target"`
+	Path string `yaml:"path"`
+}
+
+// newKustomization creates a kustomization with the standard header values
+func newKustomization() Kustomization {
+	return Kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+	}
+}
+
+// writeYAMLFile marshals an object and writes it, with an optional comment header, to a file
+func writeYAMLFile(path string, header string, object interface{}) error {
+	content, err := yaml.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(header), content...), 0644)
+}
+
+// GenerateKustomize writes a base and overlay stubs to <build>/<SAS_MANIFEST_DIR>/kustomize/
+func (order *SoftwareOrder) GenerateKustomize() error {
+	order.WriteLog(true, "Creating kustomize base and overlays ...")
+	inputs, err := order.LoadManifestInputs()
+	if err != nil {
+		return err
+	}
+	kustomizePath := inputs.ManifestPath() + "kustomize/"
+	basePath := kustomizePath + "base/"
+	if err := os.RemoveAll(basePath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(basePath, 0744); err != nil {
+		return err
+	}
+
+	// The base is a copy of the generated Kubernetes manifests since kustomize
+	// does not allow a kustomization to load files outside of its own directory.
+	base := newKustomization()
+	for _, directory := range kustomizeBaseDirectories {
+		sourcePath := inputs.ManifestPath() + "kubernetes/" + directory
+		files, err := ioutil.ReadDir(sourcePath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(basePath+directory, 0744); err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".yml") {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(sourcePath, file.Name()))
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(basePath, directory, file.Name()), content, 0644); err != nil {
+				return err
+			}
+			base.Resources = append(base.Resources, directory+"/"+file.Name())
+		}
+	}
+	if len(base.Resources) == 0 {
+		return fmt.Errorf("No Kubernetes manifests were found in %skubernetes/ to create the kustomize base", inputs.ManifestPath())
+	}
+	header := "# Generated by SAS Container Recipes. Re-generating the manifests replaces this directory.\n"
+	if err := writeYAMLFile(basePath+"kustomization.yaml", header, base); err != nil {
+		return err
+	}
+
+	// The overlays are only stubs, so do not replace ones that already exist and may have been edited
+	for _, overlay := range order.KustomizeOverlays {
+		overlayPath := kustomizePath + "overlays/" + overlay + "/"
+		if _, err := os.Stat(overlayPath + "kustomization.yaml"); err == nil {
+			order.WriteLog(true, "Keeping existing kustomize overlay "+overlayPath)
+			continue
+		}
+		if err := os.MkdirAll(overlayPath, 0744); err != nil {
+			return err
+		}
+		if err := order.writeKustomizeOverlay(inputs, overlay, overlayPath); err != nil {
+			return err
+		}
+	}
+
+	order.WriteLog(true, "Finished creating kustomize base and overlays "+kustomizePath)
+	return nil
+}
+
+// writeKustomizeOverlay creates an overlay stub with the namespace, ingress host,
+// image tags, and resource patches for a single environment.
+// Each environment gets its own <namespace>-<overlay> namespace so the overlays can share a cluster.
+func (order *SoftwareOrder) writeKustomizeOverlay(inputs *ManifestInputs, overlay string, overlayPath string) error {
+	namespace := inputs.Namespace() + "-" + overlay
+	if len(namespace) > 63 {
+		return fmt.Errorf("The namespace %s of the kustomize overlay %s is longer than 63 characters", namespace, overlay)
+	}
+	kustomization := newKustomization()
+	kustomization.Namespace = namespace
+	kustomization.Resources = []string{"../../base", "namespace.yml"}
+
+	namespaceObject := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name":   namespace,
+			"labels": map[string]string{"name": namespace},
+		},
+	}
+	if err := writeYAMLFile(overlayPath+"namespace.yml", "", namespaceObject); err != nil {
+		return err
+	}
+
+	// Every image uses the tag from the build
+	registry, registryNamespace := inputs.Registry()
+	for _, name := range inputs.ServiceNames() {
+		imageName := inputs.ProjectName() + "-" + name
+		if len(registry) > 0 {
+			imageName = registry + "/" + registryNamespace + "/" + imageName
+		}
+		kustomization.Images = append(kustomization.Images, KustomizeImage{Name: imageName, NewTag: inputs.Tag})
+	}
+
+	// Resource limits and requests from the config-<type>.yml file, as a starting point for each environment
+	resourcePatches := []string{}
+	for _, name := range inputs.ServiceNames() {
+		resources := inputs.Resources(name)
+		if len(resources) == 0 {
+			continue
+		}
+		kind := "Deployment"
+		if IsStateful(name) {
+			kind = "StatefulSet"
+		}
+		objectName := inputs.ProjectName() + "-" + inputs.ResourceName(name)
+		patch := map[string]interface{}{
+			"apiVersion": "apps/v1beta1",
+			"kind":       kind,
+			"metadata":   map[string]string{"name": objectName},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"containers": []interface{}{
+							map[string]interface{}{
+								"name":      objectName,
+								"resources": resources,
+							},
+						},
+					},
+				},
+			},
+		}
+		content, err := yaml.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		resourcePatches = append(resourcePatches, string(content))
+	}
+	if len(resourcePatches) > 0 {
+		content := "# Resources from the " + filepath.Base(order.ConfigPath) + " file\n---\n" + strings.Join(resourcePatches, "---\n")
+		if err := ioutil.WriteFile(overlayPath+"resources.yml", []byte(content), 0644); err != nil {
+			return err
+		}
+		kustomization.PatchesStrategicMerge = append(kustomization.PatchesStrategicMerge, "resources.yml")
+	}
+
+	// Each overlay routes the rules of util/static-roles-<type>/manifests/templates/k8s_ingress.j2 to its own
+	// host names, so the overlays do not collide in one cluster: the same host names as the base in the
+	// overlay's namespace, or <overlay>.<--virtual-host>
+	ingressName := inputs.ProjectName() + "-" + inputs.Ingress + "-ingress"
+	domain := namespace + "." + inputs.Var("SAS_K8S_INGRESS_DOMAIN", "company.com")
+	ingressHost := inputs.ProjectName() + "." + domain
+	if len(order.VirtualHost) > 0 && order.VirtualHost != DefaultVirtualHost {
+		domain = overlay + "." + order.VirtualHost
+		ingressHost = domain
+	}
+	ingressPatch := []map[string]string{
+		{"op": "replace", "path": "/spec/rules/0/host", "value": ingressHost},
+	}
+	if _, hasESP := inputs.Settings.Services["espserver"]; hasESP {
+		ingressPatch = append(ingressPatch, map[string]string{
+			"op": "replace", "path": "/spec/rules/1/host", "value": inputs.ProjectName() + "-esp-design." + domain,
+		})
+	}
+	if err := writeYAMLFile(overlayPath+"ingress.yml", "", ingressPatch); err != nil {
+		return err
+	}
+	ingressTarget := KustomizeJSON6902Target{Path: "ingress.yml"}
+	ingressTarget.Target.Group = "extensions"
+	ingressTarget.Target.Version = "v1beta1"
+	ingressTarget.Target.Kind = "Ingress"
+	ingressTarget.Target.Name = ingressName
+	kustomization.PatchesJSON6902 = append(kustomization.PatchesJSON6902, ingressTarget)
+
+	header := fmt.Sprintf("# Overlay stub for the '%s' environment, generated by SAS Container Recipes.\n"+
+		"# Edit this directory to keep the differences of the environment in git.\n"+
+		"# Re-generating the manifests does not replace an existing overlay.\n", overlay)
+	return writeYAMLFile(overlayPath+"kustomization.yaml", header, kustomization)
+}
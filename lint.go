@@ -0,0 +1,311 @@
+// lint.go
+// Checks each generated Dockerfile for common problems, such as an ARG that
+// is declared twice or a package install that keeps the package manager's
+// cache, after the addon lines are merged into it. The problems are written
+// to each container's log and summarized when the build finishes.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The severities of the lint rules. Only errors can fail the build, see --fail-on-lint-errors.
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+	LintInfo    = "info"
+)
+
+// LintRule is a check of the instructions of a generated Dockerfile
+type LintRule struct {
+	Name        string
+	Severity    string
+	Description string
+	check       func(state *lintState, instruction DockerfileInstruction) string // Returns the problem, if any
+}
+
+// LintProblem is an instruction of a generated Dockerfile that breaks a rule
+type LintProblem struct {
+	Rule     string
+	Severity string
+	Line     int
+	Addon    string // The addon that added the instruction, if any
+	Message  string
+}
+
+// String formats a problem as Dockerfile:<line>: <severity>: <message> [<rule>]
+func (problem LintProblem) String() string {
+	message := fmt.Sprintf("Dockerfile:%d: %s: %s [%s]", problem.Line, problem.Severity, problem.Message, problem.Rule)
+	if len(problem.Addon) > 0 {
+		message += " (addon " + problem.Addon + ")"
+	}
+	return message
+}
+
+// lintState is what the rules know about the stage of the Dockerfile that is being checked
+type lintState struct {
+	args map[string]int // The line that each ARG of the stage is declared on
+	user string         // The USER of the stage
+}
+
+var (
+	// The package manager commands that install packages, with the position of the first package
+	packageInstallRegex = regexp.MustCompile(`\b(yum|dnf|zypper)\s+((-\S+\s+)*)(install|in)\s`)
+
+	// A package with a version such as ansible-2.8.5 or ansible=2.8.5
+	pinnedPackageRegex = regexp.MustCompile(`(-[0-9]|[=<>])`)
+
+	// The commands that only root can run
+	rootCommandRegex = regexp.MustCompile(`\b(yum|dnf|zypper|useradd|groupadd|usermod|update-ca-trust)\s|\brpm\s+(-[iUe]|--install|--upgrade|--erase)`)
+
+	// The operators that separate the commands of a RUN
+	shellSeparatorRegex = regexp.MustCompile(`&&|\|\||;|\|`)
+
+	// The archives that ADD unpacks, which is the reason to use ADD instead of COPY
+	addArchiveRegex = regexp.MustCompile(`\.(tar|tar\.gz|tgz|tar\.bz2|tbz2|tar\.xz|txz)$`)
+)
+
+// The rules that are checked, in the order they are reported
+var lintRules = []LintRule{
+	{
+		Name:        "duplicate-arg",
+		Severity:    LintWarning,
+		Description: "An ARG is declared more than once in the same stage",
+		check: func(state *lintState, instruction DockerfileInstruction) string {
+			if instruction.Command != "ARG" {
+				return ""
+			}
+			name, _ := splitKeyValue(instruction.Value, "=")
+			if line, found := state.args[name]; found {
+				return fmt.Sprintf("ARG %s is already declared on line %d", name, line)
+			}
+			return ""
+		},
+	},
+	{
+		Name:        "add-instead-of-copy",
+		Severity:    LintWarning,
+		Description: "ADD is used for local files that are not archives, where COPY is meant",
+		check: func(state *lintState, instruction DockerfileInstruction) string {
+			if instruction.Command != "ADD" || len(instruction.Heredocs) > 0 {
+				return ""
+			}
+			sources := strings.Fields(instruction.Value)
+			if instruction.IsJSON {
+				sources = instruction.JSON
+			}
+			if len(sources) < 2 {
+				return ""
+			}
+			for _, source := range sources[:len(sources)-1] {
+				if strings.Contains(source, "://") || addArchiveRegex.MatchString(source) {
+					return ""
+				}
+			}
+			return "use COPY for " + strings.Join(sources[:len(sources)-1], " ") + " since ADD also downloads URLs and unpacks archives"
+		},
+	},
+	{
+		Name:        "package-cache",
+		Severity:    LintWarning,
+		Description: "A RUN installs packages without removing the package manager's cache in the same layer",
+		check: func(state *lintState, instruction DockerfileInstruction) string {
+			if instruction.Command != "RUN" || !packageInstallRegex.MatchString(instruction.Value) {
+				return ""
+			}
+			if strings.Contains(instruction.Value, " clean") || strings.Contains(instruction.Value, "/var/cache") {
+				return ""
+			}
+			return "the packages are installed without a clean, so the package cache is kept in the layer"
+		},
+	},
+	{
+		Name:        "unpinned-package",
+		Severity:    LintInfo,
+		Description: "A package is installed without a version",
+		check: func(state *lintState, instruction DockerfileInstruction) string {
+			if instruction.Command != "RUN" {
+				return ""
+			}
+			unpinned := []string{}
+			for _, command := range splitShellCommands(instruction.Value) {
+				match := packageInstallRegex.FindStringIndex(command + " ")
+				if match == nil {
+					continue
+				}
+				for _, word := range strings.Fields(command[match[1]-1:]) {
+					if strings.HasPrefix(word, "-") || strings.ContainsAny(word, "$/") || pinnedPackageRegex.MatchString(word) {
+						continue
+					}
+					unpinned = append(unpinned, word)
+				}
+			}
+			if len(unpinned) == 0 {
+				return ""
+			}
+			return "the packages " + strings.Join(unpinned, " ") + " are installed without a version"
+		},
+	},
+	{
+		Name:        "run-as-non-root",
+		Severity:    LintError,
+		Description: "A RUN that needs root comes after a USER that is not root",
+		check: func(state *lintState, instruction DockerfileInstruction) string {
+			if instruction.Command != "RUN" || isRootUser(state.user) || !rootCommandRegex.MatchString(instruction.Value) {
+				return ""
+			}
+			return fmt.Sprintf("the RUN needs root but the USER is %s: add USER root before it", state.user)
+		},
+	},
+}
+
+// LintRuleNames returns the names of the rules
+func LintRuleNames() []string {
+	names := []string{}
+	for _, rule := range lintRules {
+		names = append(names, rule.Name)
+	}
+	return names
+}
+
+// isRootUser reports if a USER runs as root, which is also the default
+func isRootUser(user string) bool {
+	name, _ := splitKeyValue(user, ":")
+	return name == "" || name == "root" || name == "0"
+}
+
+// splitShellCommands splits a RUN into its commands on &&, ||, ;, and |
+func splitShellCommands(value string) []string {
+	return shellSeparatorRegex.Split(value, -1)
+}
+
+// lintAddonLines returns the addon that added each line of a generated Dockerfile.
+// appendAddonLines starts the lines of each addon with a "# <addon>" comment and ends them with an empty line.
+func lintAddonLines(content string, addons []*Addon) map[int]*Addon {
+	result := make(map[int]*Addon)
+	var current *Addon
+	for index, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == `LABEL sas.recipe.addons="true"` {
+			current = nil
+			continue
+		}
+		if strings.HasPrefix(trimmed, "# ") {
+			for _, addon := range addons {
+				if strings.TrimSuffix(strings.TrimPrefix(trimmed, "# "), "/") == strings.TrimSuffix(addon.Path, "/") {
+					current = addon
+				}
+			}
+		}
+		if current != nil {
+			result[index+1] = current
+		}
+	}
+	return result
+}
+
+// LintDockerfile checks a generated Dockerfile against the rules. The ignore list turns rules off for
+// the whole Dockerfile, and the lint_ignore of an addon turns rules off for the lines of that addon.
+func LintDockerfile(content string, addons []*Addon, ignore []string) ([]LintProblem, error) {
+	dockerfile, err := ParseDockerfile(content)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to lint the Dockerfile, %s", err.Error())
+	}
+	addonLines := lintAddonLines(content, addons)
+
+	problems := []LintProblem{}
+	state := &lintState{args: make(map[string]int)}
+	for _, instruction := range dockerfile.Instructions {
+		if instruction.Command == "FROM" {
+			state = &lintState{args: make(map[string]int)}
+			continue
+		}
+		addon := addonLines[instruction.Line]
+		for _, rule := range lintRules {
+			if stringInSlice(rule.Name, ignore) || (addon != nil && stringInSlice(rule.Name, addon.LintIgnore)) {
+				continue
+			}
+			if message := rule.check(state, instruction); message != "" {
+				problem := LintProblem{Rule: rule.Name, Severity: rule.Severity, Line: instruction.Line, Message: message}
+				if addon != nil {
+					problem.Addon = addon.Name
+				}
+				problems = append(problems, problem)
+			}
+		}
+
+		switch instruction.Command {
+		case "ARG":
+			name, _ := splitKeyValue(instruction.Value, "=")
+			if _, found := state.args[name]; !found {
+				state.args[name] = instruction.Line
+			}
+		case "USER":
+			state.user = strings.TrimSpace(instruction.Value)
+		}
+	}
+	return problems, nil
+}
+
+// countLintProblems returns the number of problems of each severity
+func countLintProblems(problems []LintProblem) map[string]int {
+	counts := make(map[string]int)
+	for _, problem := range problems {
+		counts[problem.Severity]++
+	}
+	return counts
+}
+
+// LintSummary lists the lint errors and warnings of each image, and counts the info problems
+func (order *SoftwareOrder) LintSummary() string {
+	names := []string{}
+	for name, container := range order.Containers {
+		if len(container.LintProblems) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+
+	all := []LintProblem{}
+	lines := []string{}
+	for _, name := range names {
+		container := order.Containers[name]
+		all = append(all, container.LintProblems...)
+		reported := []string{}
+		for _, problem := range container.LintProblems {
+			if problem.Severity != LintInfo {
+				reported = append(reported, "      "+problem.String())
+			}
+		}
+		if len(reported) > 0 {
+			lines = append(lines, "  "+container.GetWholeImageName()+":")
+			lines = append(lines, reported...)
+		}
+	}
+	counts := countLintProblems(all)
+	header := fmt.Sprintf("Dockerfile lint: %d errors, %d warnings, %d info (see each container's log for the info)",
+		counts[LintError], counts[LintWarning], counts[LintInfo])
+	return strings.Join(append([]string{header}, lines...), "\n") + "\n"
+}
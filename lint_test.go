@@ -0,0 +1,98 @@
+// lint_test.go
+// Tests the lint rules of the generated Dockerfiles.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Each rule reports the instructions that break it, on their line
+func TestLintDockerfile(t *testing.T) {
+	tests := map[string]struct {
+		content  string
+		expected []string
+	}{
+		"clean": {
+			content:  "FROM centos:7\nARG MODE\nCOPY a.sh /tmp/\nRUN yum install -y curl-7.29.0 && yum clean all\n",
+			expected: []string{},
+		},
+		"duplicate-arg": {
+			content:  "FROM centos:7\nARG MODE\nARG MODE=smp\n",
+			expected: []string{"duplicate-arg:3"},
+		},
+		"duplicate-arg in another stage": {
+			content:  "FROM centos:7 AS build\nARG MODE\nFROM centos:7\nARG MODE\n",
+			expected: []string{},
+		},
+		"add-instead-of-copy": {
+			content:  "FROM centos:7\nADD a.sh /tmp/\nADD teradata.tgz /tmp/\nADD https://example.com/a.sh /tmp/\n",
+			expected: []string{"add-instead-of-copy:2"},
+		},
+		"package-cache and unpinned-package": {
+			content:  "FROM centos:7\nRUN yum install -y curl\n",
+			expected: []string{"package-cache:2", "unpinned-package:2"},
+		},
+		"unpinned-package with options and variables": {
+			content:  "FROM centos:7\nRUN zypper --non-interactive install --no-recommends sudo $EXTRA /tmp/a.rpm && zypper clean\n",
+			expected: []string{"unpinned-package:2"},
+		},
+		"run-as-non-root": {
+			content:  "FROM centos:7\nUSER sas\nRUN useradd demo\nUSER 0\nRUN useradd other\n",
+			expected: []string{"run-as-non-root:3"},
+		},
+	}
+	for name, test := range tests {
+		problems, err := LintDockerfile(test.content, nil, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		found := []string{}
+		for _, problem := range problems {
+			found = append(found, fmt.Sprintf("%s:%d", problem.Rule, problem.Line))
+		}
+		if !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("%s: expected %v, got %v", name, test.expected, found)
+		}
+	}
+}
+
+// The ignore list turns a rule off for the Dockerfile, and the lint_ignore of an addon only for its lines
+func TestLintDockerfileIgnore(t *testing.T) {
+	addon := &Addon{Name: "access-mydb", Path: "addons/access-mydb/", LintIgnore: []string{"add-instead-of-copy"}}
+	content := "FROM centos:7\nADD a.sh /tmp/\n\n# addons/access-mydb/\nADD b.sh /tmp/\n"
+
+	problems, err := LintDockerfile(content, []*Addon{addon}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(problems) != 1 || problems[0].Line != 2 || problems[0].Addon != "" {
+		t.Errorf("expected only the problem on line 2, got %v", problems)
+	}
+
+	problems, err = LintDockerfile(content, nil, []string{"add-instead-of-copy"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
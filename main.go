@@ -21,15 +21,32 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
+	// The addons command does not need a software order, such as `addons list`
+	if len(os.Args) > 1 && os.Args[1] == "addons" {
+		if err := RunAddonsCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	order, err := NewSoftwareOrder()
 	if err != nil {
 		fmt.Println("")
 		log.Fatal(err)
 	}
 
+	if order.ValidateOnly {
+		err := order.Validate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if order.GenerateManifestsOnly {
 		err := order.GenerateManifests()
 		if err != nil {
@@ -41,5 +58,12 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+
+	if len(order.DiffAgainst) > 0 {
+		err = order.ShowDiff()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	order.ShowSummary()
 }
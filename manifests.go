@@ -0,0 +1,474 @@
+// manifests.go
+// Loads the same inputs that the generate_manifests playbook uses so that
+// deployment formats other than the raw Kubernetes manifests can be created
+// from the service definitions in the build directory.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ManifestSettings mirrors the manifest-vars.yml file that is written by
+// order.GenerateManifests and read by the util/static-roles-<type>/manifests role
+type ManifestSettings struct {
+	Settings struct {
+		Base         string `yaml:"base"`
+		ProjectName  string `yaml:"project_name"`
+		K8sNamespace struct {
+			Name string `yaml:"name"`
+		} `yaml:"k8s_namespace"`
+	} `yaml:"settings"`
+	Services   map[string]ContainerConfig `yaml:"services"`
+	Registries map[string]struct {
+		URL       string `yaml:"url"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"registries"`
+}
+
+// ManifestProbe is a liveness or readiness probe that runs the healthcheck of a service's config
+type ManifestProbe struct {
+	Exec struct {
+		Command []string `yaml:"command"`
+	} `yaml:"exec"`
+	InitialDelaySeconds int `yaml:"initialDelaySeconds"`
+	PeriodSeconds       int `yaml:"periodSeconds"`
+	TimeoutSeconds      int `yaml:"timeoutSeconds"`
+	FailureThreshold    int `yaml:"failureThreshold"`
+}
+
+// ManifestSecurityContext is the securityContext of a service that runs as a numeric user
+type ManifestSecurityContext struct {
+	RunAsUser    int64  `yaml:"runAsUser"`
+	RunAsGroup   *int64 `yaml:"runAsGroup,omitempty"`
+	RunAsNonRoot bool   `yaml:"runAsNonRoot"`
+}
+
+// CustomService mirrors one entry of the custom_services section in vars_usermods.yml
+type CustomService struct {
+	DeploymentOverrides struct {
+		Environment []string `yaml:"environment"`
+		Secrets     []string `yaml:"secrets"`
+	} `yaml:"deployment_overrides"`
+}
+
+// ManifestInputs holds everything the manifests playbook would see when it runs
+type ManifestInputs struct {
+	Settings           ManifestSettings
+	Vars               map[string]interface{}   // Merged content of the playbook's vars_files
+	CustomServices     map[string]CustomService // custom_services from vars_usermods.yml
+	CustomVolumes      map[string]string        // custom_volumes from vars_usermods.yml
+	CustomVolumeMounts map[string]string        // custom_volume_mounts from vars_usermods.yml
+	BuildPath          string
+	DeploymentType     string
+	Ingress            string // The ingress is named <project-name>-<ingress>-ingress
+	Tag                string
+}
+
+// These mirror the "when" conditions in util/static-roles-<type>/manifests/tasks/main.yml
+// Services that are not in statefulServices are created as microservice Deployments.
+var statefulServices = []string{
+	"consul", "computeserver", "httpproxy", "pgpoolc", "programming",
+	"rabbitmq", "sas-casserver-primary", "sasdatasvrc",
+}
+var exposedServices = []string{
+	"consul", "computeserver", "httpproxy", "pgpoolc", "programming",
+	"rabbitmq", "sas-casserver-primary", "sasdatasvrc", "espserver",
+}
+
+// Matches "{{ NAME }}" and "{{ NAME | lower }}" Jinja expressions
+var jinjaVariableRegex = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*(\|\s*lower\s*)?\}\}`)
+
+// LoadManifestInputs reads the vars files and manifest-vars.yml from the build directory.
+// These are written by order.GenerateManifests before the manifests playbook is run.
+func (order *SoftwareOrder) LoadManifestInputs() (*ManifestInputs, error) {
+	inputs := &ManifestInputs{
+		BuildPath:      order.BuildPath,
+		DeploymentType: order.DeploymentType,
+		Ingress:        order.Deployment.Ingress,
+		Tag:            order.TagOverride,
+	}
+
+	settingsContent, err := ioutil.ReadFile(order.BuildPath + "manifest-vars.yml")
+	if err != nil {
+		return inputs, errors.New("Unable to read manifest-vars.yml, " + err.Error())
+	}
+	err = yaml.Unmarshal(settingsContent, &inputs.Settings)
+	if err != nil {
+		return inputs, errors.New("Unable to unmarshal manifest-vars.yml, " + err.Error())
+	}
+
+	// Same defaults as the "vars" section of the generate_manifests.yml playbook
+	inputs.Vars = map[string]interface{}{
+		"SAS_MANIFEST_DIR":       "manifests",
+		"SAS_K8S_NAMESPACE":      "sas-viya",
+		"SAS_K8S_INGRESS_DOMAIN": "company.com",
+	}
+
+	// Same order as the "vars_files" section of the generate_manifests.yml playbook.
+	// Values in later files replace values in earlier files.
+	varsFiles := []string{"all.yml", "soe_defaults.yml", "vars.yml", "vars_deployment.yml", "vars_usermods.yml"}
+	for _, varsFile := range varsFiles {
+		content, err := ioutil.ReadFile(order.BuildPath + varsFile)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return inputs, err
+		}
+		fileVars := make(map[string]interface{})
+		if err := yaml.Unmarshal(content, &fileVars); err != nil {
+			return inputs, fmt.Errorf("Unable to unmarshal %s, %s", varsFile, err.Error())
+		}
+		for key, value := range fileVars {
+			inputs.Vars[key] = value
+		}
+	}
+
+	// The custom sections are only defined by the user in vars_usermods.yml
+	usermods := struct {
+		CustomServices     map[string]CustomService `yaml:"custom_services"`
+		CustomVolumes      map[string]string        `yaml:"custom_volumes"`
+		CustomVolumeMounts map[string]string        `yaml:"custom_volume_mounts"`
+	}{}
+	usermodsContent, err := ioutil.ReadFile(order.BuildPath + "vars_usermods.yml")
+	if err == nil {
+		if err := yaml.Unmarshal(usermodsContent, &usermods); err != nil {
+			return inputs, errors.New("Unable to unmarshal vars_usermods.yml, " + err.Error())
+		}
+	}
+	// Images are always deployed with the tag they were built with,
+	// even when the manifests are re-generated with --generate-manifests-only
+	inputs.Tag = inputs.Var("docker_tag", inputs.Tag)
+
+	inputs.CustomServices = usermods.CustomServices
+	inputs.CustomVolumes = usermods.CustomVolumes
+	inputs.CustomVolumeMounts = usermods.CustomVolumeMounts
+	return inputs, nil
+}
+
+// Var returns a playbook variable as a string, or the fallback if it is not defined
+func (inputs *ManifestInputs) Var(name string, fallback string) string {
+	value, found := inputs.Vars[name]
+	if !found || value == nil {
+		return fallback
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// Render replaces the simple Jinja expressions used in the config-<type>.yml files,
+// such as "{{ PROJECT_NAME }}" or "{{ SECURE_CONSUL | lower }}", with the playbook variables.
+// Expressions that reference unknown variables are left as-is.
+func (inputs *ManifestInputs) Render(value string) string {
+	return jinjaVariableRegex.ReplaceAllStringFunc(value, func(expression string) string {
+		match := jinjaVariableRegex.FindStringSubmatch(expression)
+		if _, found := inputs.Vars[match[1]]; !found {
+			return expression
+		}
+		result := inputs.Var(match[1], "")
+		if len(match[2]) > 0 {
+			result = strings.ToLower(result)
+		}
+		return result
+	})
+}
+
+// ManifestPath is the directory the raw Kubernetes manifests are written to, <build>/<SAS_MANIFEST_DIR>/
+func (inputs *ManifestInputs) ManifestPath() string {
+	return inputs.BuildPath + inputs.Var("SAS_MANIFEST_DIR", "manifests") + "/"
+}
+
+// Namespace is the Kubernetes namespace the deployment is created in
+func (inputs *ManifestInputs) Namespace() string {
+	return inputs.Var("SAS_K8S_NAMESPACE", "sas-viya")
+}
+
+// ProjectName is the prefix of every image and Kubernetes object name
+func (inputs *ManifestInputs) ProjectName() string {
+	return inputs.Settings.Settings.ProjectName
+}
+
+// IngressHost is the host name that the Ingress routes to the httpproxy service
+func (inputs *ManifestInputs) IngressHost() string {
+	return fmt.Sprintf("%s.%s.%s", inputs.ProjectName(), inputs.Namespace(),
+		inputs.Var("SAS_K8S_INGRESS_DOMAIN", "company.com"))
+}
+
+// Registry returns the Docker registry URL and namespace the images were pushed to
+func (inputs *ManifestInputs) Registry() (string, string) {
+	for _, registry := range inputs.Settings.Registries {
+		return strings.TrimSpace(registry.URL), strings.TrimSpace(registry.Namespace)
+	}
+	return "", ""
+}
+
+// ServiceNames returns the sorted names of the services in manifest-vars.yml
+func (inputs *ManifestInputs) ServiceNames() []string {
+	names := []string{}
+	for name := range inputs.Settings.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResourceName is the suffix of the Kubernetes objects for a service.
+// The CAS controller is always referred to as "cas" in the manifests.
+func (inputs *ManifestInputs) ResourceName(service string) string {
+	if service == "sas-casserver-primary" {
+		return "cas"
+	}
+	return strings.ToLower(service)
+}
+
+// Environment returns the rendered environment of a service as ordered name and value pairs,
+// with the custom_services deployment_overrides from vars_usermods.yml applied.
+func (inputs *ManifestInputs) Environment(service string) [][2]string {
+	values := inputs.Settings.Services[service].Environment
+	if custom, found := inputs.CustomServices[service]; found {
+		values = mergeKeyValues(values, custom.DeploymentOverrides.Environment)
+	}
+	result := [][2]string{}
+	for _, item := range values {
+		key, value := splitKeyValue(item, "=")
+		result = append(result, [2]string{key, inputs.Render(value)})
+	}
+	return result
+}
+
+// Secrets returns the secrets of a service as ordered name and value pairs,
+// with the custom_services deployment_overrides from vars_usermods.yml applied.
+func (inputs *ManifestInputs) Secrets(service string) [][2]string {
+	values := inputs.Settings.Services[service].Secrets
+	if custom, found := inputs.CustomServices[service]; found {
+		values = mergeKeyValues(values, custom.DeploymentOverrides.Secrets)
+	}
+	result := [][2]string{}
+	for _, item := range values {
+		key, value := splitKeyValue(item, "=")
+		result = append(result, [2]string{key, value})
+	}
+	return result
+}
+
+// Ports returns the container side of each "<container>:<host>" port mapping of a service
+func (inputs *ManifestInputs) Ports(service string) []string {
+	ports := []string{}
+	for _, item := range inputs.Settings.Services[service].Ports {
+		ports = append(ports, strings.TrimSpace(strings.Split(item, ":")[0]))
+	}
+	return ports
+}
+
+// Resources returns the "<resource>=<quantity>" limits and requests of a service as maps
+func (inputs *ManifestInputs) Resources(service string) map[string]map[string]string {
+	config := inputs.Settings.Services[service]
+	result := make(map[string]map[string]string)
+	sections := map[string][]string{
+		"limits":   config.Resources.Limits,
+		"requests": config.Resources.Requests,
+	}
+	for section, items := range sections {
+		if len(items) == 0 {
+			continue
+		}
+		result[section] = make(map[string]string)
+		for _, item := range items {
+			key, value := splitKeyValue(item, "=")
+			result[section][key] = value
+		}
+	}
+	return result
+}
+
+// Volumes returns the "<name>=<path>" volumes of a service as ordered name and path pairs
+func (inputs *ManifestInputs) Volumes(service string) [][2]string {
+	result := [][2]string{}
+	for _, item := range inputs.Settings.Services[service].Volumes {
+		key, value := splitKeyValue(item, "=")
+		result = append(result, [2]string{key, value})
+	}
+	return result
+}
+
+// Files returns the files that are mounted into the container of a service from a ConfigMap or a Secret.
+// Each source is relative to the build directory, where order.GenerateManifests copies the files.
+func (inputs *ManifestInputs) Files(service string) []ContainerFile {
+	return inputs.Settings.Services[service].Files
+}
+
+// CopyFiles copies the files of a service to <destination>/<service>/<name> with the mode of each file
+func (inputs *ManifestInputs) CopyFiles(service string, destination string) error {
+	for _, file := range inputs.Files(service) {
+		content, err := ioutil.ReadFile(inputs.BuildPath + file.Source)
+		if err != nil {
+			return fmt.Errorf("Unable to read the file %s of %s, %s", file.Name, service, err.Error())
+		}
+		mode := os.FileMode(0644)
+		if file.Mode > 0 {
+			mode = os.FileMode(file.Mode)
+		}
+		path := filepath.Join(destination, service, file.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0744); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, content, mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Probe returns the readiness probe that runs the healthcheck of a service, or nil if the service has no healthcheck
+func (inputs *ManifestInputs) Probe(service string) *ManifestProbe {
+	healthcheck := inputs.Settings.Services[service].Healthcheck
+	if len(healthcheck.Command) == 0 {
+		return nil
+	}
+	healthcheck = healthcheck.withDefaults()
+	probe := &ManifestProbe{
+		InitialDelaySeconds: healthcheck.StartPeriod,
+		PeriodSeconds:       healthcheck.Interval,
+		TimeoutSeconds:      healthcheck.Timeout,
+		FailureThreshold:    healthcheck.Retries,
+	}
+	probe.Exec.Command = []string{"/bin/sh", "-c", healthcheck.Command}
+	return probe
+}
+
+// LivenessProbe returns the same probe as Probe if the healthcheck of a service has a start_period, or nil.
+// Without a start period a service that is slow to start would be restarted before it is ready, so only
+// the readiness probe is used, like the probes of util/static-roles-<type>/manifests/templates/pets_k8s.j2.
+func (inputs *ManifestInputs) LivenessProbe(service string) *ManifestProbe {
+	if inputs.Settings.Services[service].Healthcheck.StartPeriod <= 0 {
+		return nil
+	}
+	return inputs.Probe(service)
+}
+
+// SecurityContext returns the securityContext of a service with a numeric user such as 1001 or 1001:1001.
+// Kubernetes can only check that a user is not root by its ID, so a user name such as sas returns nil.
+func (inputs *ManifestInputs) SecurityContext(service string) *ManifestSecurityContext {
+	user, group := splitKeyValue(inputs.Settings.Services[service].User, ":")
+	userID, err := strconv.ParseInt(user, 10, 64)
+	if err != nil {
+		return nil
+	}
+	context := &ManifestSecurityContext{RunAsUser: userID, RunAsNonRoot: userID != 0}
+	if groupID, err := strconv.ParseInt(group, 10, 64); err == nil {
+		context.RunAsGroup = &groupID
+	}
+	return context
+}
+
+// CustomYAML parses one of the literal YAML blocks from custom_volumes or custom_volume_mounts
+func (inputs *ManifestInputs) CustomYAML(blocks map[string]string, service string) ([]interface{}, error) {
+	result := []interface{}{}
+	block, found := blocks[service]
+	if !found || len(strings.TrimSpace(block)) == 0 {
+		return result, nil
+	}
+	if err := yaml.Unmarshal([]byte(block), &result); err != nil {
+		return result, fmt.Errorf("Unable to parse the custom volumes of %s in vars_usermods.yml, %s", service, err.Error())
+	}
+	return result, nil
+}
+
+// IsStateful reports if a service is created as a StatefulSet instead of a Deployment
+func IsStateful(service string) bool {
+	return stringInSlice(service, statefulServices)
+}
+
+// IsExposed reports if a service has a Kubernetes Service object
+func IsExposed(service string) bool {
+	return stringInSlice(service, exposedServices)
+}
+
+// splitKeyValue splits an item such as "KEY=VALUE" on the first separator
+func splitKeyValue(item string, separator string) (string, string) {
+	parts := strings.SplitN(item, separator, 2)
+	if len(parts) == 1 {
+		return strings.TrimSpace(parts[0]), ""
+	}
+	return strings.TrimSpace(parts[0]), parts[1]
+}
+
+// mergeKeyValues replaces the "KEY=VALUE" items in base that have the same key
+// as an item in overrides, keeping their position, and appends the remaining overrides.
+func mergeKeyValues(base []string, overrides []string) []string {
+	result := append([]string{}, base...)
+	for _, override := range overrides {
+		overrideKey, _ := splitKeyValue(override, "=")
+		overridden := false
+		for index, item := range result {
+			if key, _ := splitKeyValue(item, "="); key == overrideKey {
+				result[index] = override
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			result = append(result, override)
+		}
+	}
+	return result
+}
+
+// stringInSlice reports if the value is an item in the list
+func stringInSlice(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// copyDirectory recursively copies the files of a directory tree on the build machine
+func copyDirectory(source string, destination string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, relativePath)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0744)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, content, 0644)
+	})
+}
@@ -22,7 +22,6 @@ import (
 	"encoding/base64"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 
 	"archive/zip"
@@ -42,10 +41,13 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 )
 
@@ -56,6 +58,9 @@ const RecipeVersion = "19.04.0"
 // example: 34 = version 3.4
 const SasViyaVersion = "34"
 
+// DefaultVirtualHost is the placeholder value of the --virtual-host argument
+const DefaultVirtualHost = "myvirtualhost.mycompany.com"
+
 // ConfigPath is the path to the configuration file that's used to load custom container attributes
 // NOTE: this path changes to config-<deployment-type>.yml
 var ConfigPath = "config-full.yml"
@@ -80,6 +85,29 @@ type SoftwareOrder struct {
 	SkipMirrorValidation  bool     `yaml:"Skip Mirror Validation  "`
 	SkipDockerValidation  bool     `yaml:"Skip Docker Validation  "`
 	GenerateManifestsOnly bool     `yaml:"Generate Manifests Only "`
+	ManifestFormats       []string `yaml:"Manifest Formats        "`
+	KustomizeOverlays     []string `yaml:"Kustomize Overlays      "`
+	DiffAgainst           string   `yaml:"Diff Against            "`
+	KubernetesVersion     string   `yaml:"Kubernetes Version      "`
+	SkipSchemaValidation  bool     `yaml:"Skip Schema Validation  "`
+	ConfigOverlays        []string `yaml:"Config Overlays         "`
+	ValidateOnly          bool     `yaml:"Validate Only           "`
+	ArtifactCache         string   `yaml:"Artifact Cache          "`
+	DockerfileTemplates   string   `yaml:"Dockerfile Templates    "`
+	BuildArgs             []string `yaml:"Build Args              "`
+	Labels                []string `yaml:"Labels                  "`
+	HTTPProxy             string   `yaml:"-"`
+	HTTPSProxy            string   `yaml:"-"`
+	NoProxy               string   `yaml:"-"`
+	Repositories          string   `yaml:"Repositories            "`
+	StripBuildTools       bool     `yaml:"Strip Build Tools       "`
+	Squash                bool     `yaml:"Squash                  "`
+	LintIgnore            []string `yaml:"Lint Ignore             "`
+	FailOnLintErrors      bool     `yaml:"Fail On Lint Errors     "`
+	SourceRevision        string   `yaml:"Source Revision         "`
+	SkipSBOM              bool     `yaml:"Skip SBOM               "`
+	SBOMLabel             bool     `yaml:"SBOM Label              "`
+	RequireSBOM           bool     `yaml:"Require SBOM            "`
 
 	// Build attributes
 	Log          *os.File              `yaml:"-"`                        // File handle for log path
@@ -87,6 +115,9 @@ type SoftwareOrder struct {
 	BuildOnly    []string              `yaml:"Build Only              "` // Only build these specific containers if they're in the list of entitled containers. The 'multiple' deployment type utilizes this to build only 3 images.
 	Containers   map[string]*Container `yaml:"-"`                        // Individual containers build list
 	Config       map[string]ConfigMap  `yaml:"-"`                        // Static values and defaults are loaded from the configmap yaml
+	Deployment   DeploymentDefinition  `yaml:"-"`                        // The --type definition from deployment-types.yml
+	AddonConfigs []*Addon              `yaml:"-"`                        // The addon_config.yml of each addon in order.AddOns
+	Templates    *template.Template    `yaml:"-"`                        // The Dockerfile templates with the --dockerfile-templates overrides
 	ConfigPath   string                `yaml:"-"`                        // config-<deployment-type>.yml file for custom or static values
 	LogPath      string                `yaml:"-"`                        // Path to the build directory with the log file name
 	PlaybookPath string                `yaml:"-"`                        // Build path + "sas_viya_playbook"
@@ -99,6 +130,9 @@ type SoftwareOrder struct {
 	TimestampTag string                `yaml:"Timestamp Tag           "` // Allows for datetime on each temp build bfile
 	InDocker     bool                  `yaml:"-"`                        // If we are running in a docker container
 
+	// The platform of each base image, see order.DetectPlatform
+	Platforms map[string]PlatformDefinition `yaml:"-"`
+
 	// Metrics
 	StartTime      time.Time      `yaml:"-"`
 	EndTime        time.Time      `yaml:"-"`
@@ -119,6 +153,8 @@ type SoftwareOrder struct {
 	SOEZipPath string `yaml:"-"` // Used to load licenses
 	OrderOOM   struct {
 		OomFormatVersion string `json:"oomFormatVersion"`
+		OrderNumber      string `json:"orderNumber"` // Empty if the order does not record it
+		Release          string `json:"release"`     // The SAS Viya release of the order, empty if the order does not record it
 		MetaRepo         struct {
 			URL        string   `json:"url"`
 			Rpm        string   `json:"rpm"`
@@ -226,8 +262,11 @@ func NewSoftwareOrder() (*SoftwareOrder, error) {
 		return order, err
 	}
 
-	// Do not load any more Software Order values, just allow order.GenerateManifests() to be called
-	if order.GenerateManifestsOnly {
+	// Point to custom configuration yaml files
+	order.ConfigPath = order.Deployment.Config
+
+	// Do not load any more Software Order values, just allow order.GenerateManifests() or order.Validate() to be called
+	if order.GenerateManifestsOnly || order.ValidateOnly {
 		return order, nil
 	}
 
@@ -243,12 +282,6 @@ func NewSoftwareOrder() (*SoftwareOrder, error) {
 		order.InDocker = false
 	}
 
-	// Point to custom configuration yaml files
-	order.ConfigPath = "config-full.yml"
-	if order.DeploymentType == "multiple" {
-		order.ConfigPath = "config-multiple.yml"
-	}
-
 	// Start a worker pool and wait for all workers to finish
 	workerCount := 0 // Number of goroutines started
 	done := make(chan int)
@@ -289,6 +322,21 @@ func NewSoftwareOrder() (*SoftwareOrder, error) {
 		case <-done:
 			doneCount++
 			if doneCount == workerCount {
+				// Check the config and addon files against the containers in the order before they are used
+				inventory := []string{}
+				for name := range order.Containers {
+					inventory = append(inventory, name)
+				}
+				sort.Strings(inventory)
+				if err := order.ValidateFiles(inventory); err != nil {
+					return order, err
+				}
+				if !order.Deployment.SingleContainer {
+					if err := order.LoadConfig(); err != nil {
+						return order, err
+					}
+				}
+
 				// After the configs have been loaded then pre-build the containers and generate the manifests
 				err := order.Prepare()
 				if err != nil {
@@ -409,10 +457,23 @@ func (order *SoftwareOrder) GetIntermediateStatus(progress chan string) {
 		strings.Join(finishedContainers, ", "), strings.Join(remainingContainers, ", "))
 }
 
+// stringListFlag is an argument that can be given more than once, such as `--config a.yml --config b.yml`
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 // LoadCommands recieves flags and arguments, parse them, and load them into the order
 func (order *SoftwareOrder) LoadCommands() error {
 	// Standard format that arguments must comply with
 	regexNoSpecialCharacters := regexp.MustCompile("^[_A-z0-9]*([_A-z0-9\\-\\.]*)$")
+	regexOverlayName := regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
 
 	// Required arguments
 	license := flag.String("zip", "", "")
@@ -420,7 +481,7 @@ func (order *SoftwareOrder) LoadCommands() error {
 	dockerRegistry := flag.String("docker-registry-url", "", "")
 
 	// Optional arguments
-	virtualHost := flag.String("virtual-host", "myvirtualhost.mycompany.com", "")
+	virtualHost := flag.String("virtual-host", DefaultVirtualHost, "")
 	addons := flag.String("addons", "", "")
 	baseImage := flag.String("base-image", "centos:7", "")
 	mirrorURL := flag.String("mirror-url", "https://ses.sas.download/ses/", "")
@@ -433,7 +494,32 @@ func (order *SoftwareOrder) LoadCommands() error {
 	skipMirrorValidation := flag.Bool("skip-mirror-url-validation", false, "")
 	skipDockerValidation := flag.Bool("skip-docker-url-validation", false, "")
 	generateManifestsOnly := flag.Bool("generate-manifests-only", false, "")
+	manifestFormat := flag.String("manifest-format", "kubernetes", "")
+	kustomizeOverlays := flag.String("kustomize-overlays", "dev,prod", "")
+	diffAgainst := flag.String("diff-against", "", "")
+	kubernetesVersion := flag.String("kubernetes-version", DefaultKubernetesVersion, "")
+	skipManifestValidation := flag.Bool("skip-manifest-validation", false, "")
+	configOverlays := stringListFlag{}
+	flag.Var(&configOverlays, "config", "")
 	builderPort := flag.String("builder-port", "1976", "")
+	artifactCache := flag.String("artifact-cache", "", "")
+	dockerfileTemplates := flag.String("dockerfile-templates", "", "")
+	buildArgs := stringListFlag{}
+	flag.Var(&buildArgs, "build-arg", "")
+	labels := stringListFlag{}
+	flag.Var(&labels, "label", "")
+	httpProxy := flag.String("http-proxy", "", "")
+	httpsProxy := flag.String("https-proxy", "", "")
+	noProxy := flag.String("no-proxy", "", "")
+	repositories := flag.String("repositories", "", "")
+	stripBuildTools := flag.Bool("strip-build-tools", false, "")
+	squash := flag.Bool("squash", false, "")
+	lintIgnore := flag.String("lint-ignore", "", "")
+	failOnLintErrors := flag.Bool("fail-on-lint-errors", false, "")
+	sourceRevision := flag.String("source-revision", "", "")
+	skipSBOM := flag.Bool("skip-sbom", false, "")
+	sbomLabel := flag.Bool("sbom-label", false, "")
+	requireSBOM := flag.Bool("require-sbom", false, "")
 
 	// By default detect the cpu core count and utilize all of them
 	defaultWorkerCount := runtime.NumCPU()
@@ -450,12 +536,18 @@ func (order *SoftwareOrder) LoadCommands() error {
 		}
 		os.Exit(0)
 	}
+
+	// The validate command only checks the config and addon files, such as `validate --type full --config site.yml`
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		order.ValidateOnly = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 	if *version == true {
 		fmt.Println("SAS Container Recipes v" + RecipeVersion)
 		os.Exit(0)
 	}
-	if len(os.Args) == 1 {
+	if len(os.Args) == 1 && !order.ValidateOnly {
 		flag.Usage()
 	}
 
@@ -481,23 +573,66 @@ func (order *SoftwareOrder) LoadCommands() error {
 		order.WriteLog(true, progressString)
 	}
 
-	// Always require a deployment type
-	if *deploymentType != "multiple" && *deploymentType != "full" && *deploymentType != "single" {
-		err := errors.New("a valid '--type' is required: choose between single, multiple, or full")
+	// Always require a deployment type that is defined in the deployment-types.yml file
+	deploymentTypes, err := LoadDeploymentTypes(DeploymentTypesPath)
+	if err != nil {
 		return err
 	}
 	order.DeploymentType = strings.ToLower(*deploymentType)
+	definition, found := deploymentTypes[order.DeploymentType]
+	if !found {
+		return fmt.Errorf("a valid '--type' is required: choose between %s", deploymentTypeNames(deploymentTypes))
+	}
+	order.Deployment = definition
 
-	// Always require a license except to re-generate manifests
-	if *license == "" && !order.GenerateManifestsOnly {
+	// Always require a license except to re-generate manifests or to validate the config files
+	if *license == "" && !order.GenerateManifestsOnly && !order.ValidateOnly {
 		err := errors.New("a software order email (SOE) '--license' file is required")
 		return err
 	}
 	order.SOEZipPath = *license
-	if !strings.HasSuffix(order.SOEZipPath, ".zip") && !order.GenerateManifestsOnly {
+	if !strings.HasSuffix(order.SOEZipPath, ".zip") && !order.GenerateManifestsOnly && (!order.ValidateOnly || order.SOEZipPath != "") {
 		return errors.New("the Software Order Email (SOE) argument '--zip' must be a file with the '.zip' extension.")
 	}
 
+	// Optional: NAME=value build arguments and name=value labels for every image.
+	// The build_args and labels of a container's config replace the ones with the same name.
+	order.BuildArgs = []string(buildArgs)
+	for _, buildArg := range order.BuildArgs {
+		if message := validateConfigItem("build_args", buildArg); message != "" {
+			return fmt.Errorf("invalid '--build-arg': %s", message)
+		}
+	}
+	order.Labels = []string(labels)
+	for _, label := range order.Labels {
+		if message := validateConfigItem("labels", label); message != "" {
+			return fmt.Errorf("invalid '--label': %s", message)
+		}
+	}
+
+	// Optional: a proxy for the image builds. It is not added to the images or to the build summary,
+	// since it can contain a password.
+	order.HTTPProxy = strings.TrimSpace(*httpProxy)
+	order.HTTPSProxy = strings.TrimSpace(*httpsProxy)
+	order.NoProxy = strings.TrimSpace(*noProxy)
+	for name, proxy := range map[string]string{"--http-proxy": order.HTTPProxy, "--https-proxy": order.HTTPSProxy} {
+		if len(proxy) > 0 && !strings.HasPrefix(proxy, "http://") && !strings.HasPrefix(proxy, "https://") {
+			return fmt.Errorf("invalid '%s': the proxy must be a URL such as http://proxy.mycompany.com:3128", name)
+		}
+	}
+
+	// Optional: a directory of .repo files, such as internal mirrors, that are added before Ansible is installed
+	order.Repositories = strings.TrimSpace(*repositories)
+	if order.Repositories != "" {
+		files, err := RepositoryFiles(order.Repositories)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("invalid '--repositories' %s: the directory does not contain any .repo files", order.Repositories)
+		}
+	}
+
 	// Optional: Parse the list of addons
 	*addons = strings.TrimSpace(*addons)
 	if *addons == "" {
@@ -507,41 +642,59 @@ func (order *SoftwareOrder) LoadCommands() error {
 		spaces, _ := regexp.Compile("[ ,]+") // math spaces or commas
 		addonString := spaces.ReplaceAllString(strings.TrimSpace(*addons), " ")
 
+		// Each addon is found at the specified path or in addons/ADDON. The addons they
+		// require are added before them and invalid combinations are rejected.
 		addonList := strings.Split(addonString, " ")
-		for _, addon := range addonList {
-
-			addonPath := addon
 
-			// if addon does not exist at specified path, check addons/ADDON.
-			// If addons/ADDON does not exist, return an error
-			if _, err := os.Stat(addonPath); err != nil {
-				// Try with 'addons/'
-				addonPath = "addons/" + addonPath
-				if _, err = os.Stat(addonPath); err != nil {
-					return fmt.Errorf("Addon %s could not be found", addon)
-				}
+		// Addon packages are unpacked into the build directory and then used like an addon directory
+		packages := make(map[string]string)
+		for index, name := range addonList {
+			if !isAddonPackage(name) {
+				continue
 			}
-			if !strings.HasSuffix(addonPath, "/") {
-				addonPath = addonPath + "/"
+			path, err := UnpackAddon(name, fmt.Sprintf("builds/%s-%s/addons/", order.DeploymentType, order.TimestampTag))
+			if err != nil {
+				return err
 			}
-			order.AddOns = append(order.AddOns, addonPath)
+			packages[path] = name
+			addonList[index] = path
+		}
+		// An addon's build_args can also be given with --build-arg
+		addonBuildArgs := append([]string{}, providedBuildArgs...)
+		for _, buildArg := range order.BuildArgs {
+			name, _ := splitKeyValue(buildArg, "=")
+			addonBuildArgs = append(addonBuildArgs, name)
+		}
+		addons, err := ResolveAddons(addonList, order.DeploymentType, deploymentTypes, addonBuildArgs)
+		if err != nil {
+			return err
+		}
+		order.AddonConfigs = addons
+		for _, addon := range addons {
+			addon.Package = packages[addon.Path]
+			order.AddOns = append(order.AddOns, addon.Path)
 		}
-	}
 
-	// Detect the platform based on the image
-	order.BaseImage = *baseImage
-	if strings.Contains(order.BaseImage, "suse") {
-		order.Platform = "suse"
-	} else {
-		// By default use rpm + yum
-		order.Platform = "redhat"
+		// The vendor artifacts of the addons are found in the addon directories or in the
+		// <addon> directories of the --artifact-cache, and their checksums are checked
+		order.ArtifactCache = *artifactCache
+		if len(order.ArtifactCache) > 0 {
+			if _, err := os.Stat(order.ArtifactCache); err != nil {
+				return fmt.Errorf("The --artifact-cache directory %s cannot be found, %s", order.ArtifactCache, err.Error())
+			}
+		}
+		problems := []string{}
+		for _, addon := range addons {
+			problems = append(problems, addon.ResolveArtifacts(order.ArtifactCache)...)
+		}
+		if len(problems) > 0 {
+			return errors.New(strings.Join(problems, "\n"))
+		}
 	}
 
-	// A mirror is optional, except in the case of using an opensuse base image for single container
+	// The platform is detected from the base image once it has been pulled (see order.LoadDocker)
+	order.BaseImage = *baseImage
 	order.MirrorURL = *mirrorURL
-	if len(order.MirrorURL) == 0 && order.DeploymentType == "single" && order.Platform == "suse" {
-		return errors.New("a --mirror-url argument is required for a base suse single container")
-	}
 
 	// Optional: override the standard tag format
 	order.TagOverride = *tagOverride
@@ -556,7 +709,7 @@ func (order *SoftwareOrder) LoadCommands() error {
 	}
 
 	// Require a docker namespace for multi and full if the manifests are not being re-generated
-	if *dockerNamespace == "" && (order.DeploymentType == "multiple" || order.DeploymentType == "full") && !order.GenerateManifestsOnly {
+	if *dockerNamespace == "" && !order.Deployment.SingleContainer && !order.GenerateManifestsOnly && !order.ValidateOnly {
 		return errors.New("a '--docker-namespace' argument is required")
 	}
 	order.DockerNamespace = *dockerNamespace
@@ -565,16 +718,14 @@ func (order *SoftwareOrder) LoadCommands() error {
 	}
 
 	// Require a docker registry for multi and full
-	if *dockerRegistry == "" && !order.GenerateManifestsOnly &&
-		(order.DeploymentType == "multiple" || order.DeploymentType == "full") {
+	if *dockerRegistry == "" && !order.GenerateManifestsOnly && !order.ValidateOnly &&
+		!order.Deployment.SingleContainer {
 		return errors.New("a '--docker-registry-url' argument is required")
 	}
 
 	// The deployment type utilizes the order.BuildOnly list
 	// Note: the 'full' deployment type builds everything, omitting the --build-only argument
-	if order.DeploymentType == "multiple" {
-		order.BuildOnly = []string{"programming", "httpproxy", "sas-casserver-primary"}
-	}
+	order.BuildOnly = order.Deployment.BuildOnly
 	if order.DeploymentType == "full" {
 		order.WriteLog(true, `
   _______  ______  _____ ____  ___ __  __ _____ _   _ _____  _    _
@@ -585,6 +736,120 @@ func (order *SoftwareOrder) LoadCommands() error {
 			`)
 	}
 
+	// Optional: additional deployment formats that are created alongside the Kubernetes manifests
+	order.ManifestFormats = []string{}
+	for _, format := range regexp.MustCompile("[ ,]+").Split(strings.TrimSpace(*manifestFormat), -1) {
+		format = strings.ToLower(format)
+		if format == "" || format == "kubernetes" {
+			// The raw Kubernetes manifests are always created
+			continue
+		}
+		if format != "helm" && format != "kustomize" {
+			return fmt.Errorf("invalid '--manifest-format' %s: choose between kubernetes, helm, or kustomize", format)
+		}
+		if order.Deployment.SingleContainer {
+			return errors.New("the '--manifest-format' argument can only be used with deployment types that generate Kubernetes manifests")
+		}
+		order.ManifestFormats = append(order.ManifestFormats, format)
+	}
+
+	// Optional: the environments that receive a kustomize overlay stub
+	order.KustomizeOverlays = []string{}
+	for _, overlay := range regexp.MustCompile("[ ,]+").Split(strings.TrimSpace(*kustomizeOverlays), -1) {
+		if overlay == "" {
+			continue
+		}
+		// The name is a directory under overlays/ and the suffix of the overlay's namespace
+		if !regexOverlayName.Match([]byte(overlay)) {
+			return fmt.Errorf("invalid '--kustomize-overlays' name %s: the name can only contain lowercase letters, numbers, and '-', and must start and end with a letter or number", overlay)
+		}
+		order.KustomizeOverlays = append(order.KustomizeOverlays, overlay)
+	}
+
+	// Optional: config files that are merged over the config-<deployment-type>.yml in the order they are given
+	order.ConfigOverlays = []string(configOverlays)
+	for _, configOverlay := range order.ConfigOverlays {
+		if order.Deployment.SingleContainer {
+			return errors.New("the '--config' argument can only be used with deployment types that generate Kubernetes manifests")
+		}
+		if order.GenerateManifestsOnly {
+			// The manifests are re-generated from the vars of the previous build, which already merged its --config files
+			return errors.New("the '--config' argument cannot be used with '--generate-manifests-only': rebuild to apply the config to the images and the manifests")
+		}
+		if _, err := os.Stat(configOverlay); err != nil {
+			return fmt.Errorf("invalid '--config' %s: %s", configOverlay, err.Error())
+		}
+	}
+
+	// Optional: the Kubernetes version that the generated manifests are validated against
+	order.KubernetesVersion = *kubernetesVersion
+	order.SkipSchemaValidation = *skipManifestValidation
+	if !order.SkipSchemaValidation && !order.Deployment.SingleContainer {
+		if _, err := LoadKubernetesSchemas(order.KubernetesVersion); err != nil {
+			return fmt.Errorf("invalid '--kubernetes-version': %s", err.Error())
+		}
+	}
+
+	// Optional: a previous build directory to compare the manifests and Dockerfiles against
+	order.DiffAgainst = strings.TrimSpace(*diffAgainst)
+	if order.DiffAgainst != "" {
+		if order.Deployment.SingleContainer {
+			return errors.New("the '--diff-against' argument can only be used with deployment types that generate Kubernetes manifests")
+		}
+		if _, err := os.Stat(order.DiffAgainst); os.IsNotExist(err) {
+			return fmt.Errorf("invalid '--diff-against' %s: the build directory does not exist", order.DiffAgainst)
+		}
+	}
+
+	// Optional: a directory of Dockerfile templates that replace the defaults in util/dockerfile-templates/
+	order.DockerfileTemplates = strings.TrimSpace(*dockerfileTemplates)
+	if order.DockerfileTemplates != "" {
+		if order.Deployment.SingleContainer {
+			return errors.New("the '--dockerfile-templates' argument can only be used with deployment types that build an image for each container")
+		}
+		if _, err := os.Stat(order.DockerfileTemplates); err != nil {
+			return fmt.Errorf("invalid '--dockerfile-templates' %s: %s", order.DockerfileTemplates, err.Error())
+		}
+	}
+	if !order.Deployment.SingleContainer {
+		order.Templates, err = LoadDockerfileTemplates(order.DockerfileTemplates)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Optional: remove Ansible and the playbook from the images and squash their layers
+	order.StripBuildTools = *stripBuildTools
+	order.Squash = *squash
+	if order.Deployment.SingleContainer && (order.StripBuildTools || order.Squash) {
+		return errors.New("the '--strip-build-tools' and '--squash' arguments can only be used with deployment types that build an image for each container")
+	}
+
+	// Optional: the Dockerfile lint rules that are not checked, and whether a lint error fails the build
+	order.LintIgnore = []string{}
+	for _, rule := range strings.FieldsFunc(*lintIgnore, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !stringInSlice(rule, LintRuleNames()) {
+			return fmt.Errorf("invalid '--lint-ignore' rule '%s': choose between %s", rule, strings.Join(LintRuleNames(), ", "))
+		}
+		order.LintIgnore = append(order.LintIgnore, rule)
+	}
+	order.FailOnLintErrors = *failOnLintErrors
+
+	// Optional: the commit of this project, which build.sh finds with git, for the org.opencontainers.image.revision label
+	order.SourceRevision = strings.TrimSpace(*sourceRevision)
+
+	// Optional: the SBOM of each image is written to its build directory unless --skip-sbom is given,
+	// and --sbom-label also adds it to the image. With --require-sbom an image without its SBOM fails the build.
+	order.SkipSBOM = *skipSBOM
+	order.SBOMLabel = *sbomLabel
+	order.RequireSBOM = *requireSBOM
+	if order.SkipSBOM && order.SBOMLabel {
+		return errors.New("the '--sbom-label' argument cannot be used with '--skip-sbom'")
+	}
+	if order.SkipSBOM && order.RequireSBOM {
+		return errors.New("the '--require-sbom' argument cannot be used with '--skip-sbom'")
+	}
+
 	// Parse the list of buildOnly arguments
 	*buildOnly = strings.TrimSpace(*buildOnly)
 	if *buildOnly != "" {
@@ -618,17 +883,38 @@ func buildWorker(id int, containers <-chan *Container, done chan<- string, progr
 			container.Status = Built
 		}
 
+		// List the packages of the image before the provenance, since --sbom-label changes the image
+		if !container.SoftwareOrder.SkipSBOM {
+			progress <- "Creating the SBOM of " + container.GetWholeImageName() + " ..."
+			// Like the provenance, the SBOM does not fail an image that was built unless --require-sbom is given
+			if err := container.WriteSBOM(); err != nil {
+				if container.SoftwareOrder.RequireSBOM {
+					container.Status = Failed
+					fail <- container.GetWholeImageName() + " SBOM " + err.Error()
+					done <- container.Name
+					return
+				}
+				container.SoftwareOrder.WriteLog(true, "[WARNING] Unable to create the SBOM of "+container.GetWholeImageName()+": "+err.Error())
+			}
+		}
+
+		// Record the inputs of the build next to the container's log
+		if err := container.WriteProvenance(); err != nil {
+			container.SoftwareOrder.WriteLog(true, "Unable to write the provenance of "+container.GetWholeImageName()+": "+err.Error())
+		}
+
 		// Get each image's size
-		filterArgs := filters.NewArgs()
-		filterArgs.Add("reference", container.GetWholeImageName())
-		imageInfo, err := container.SoftwareOrder.DockerClient.ImageList(container.SoftwareOrder.BuildContext,
-			types.ImageListOptions{Filters: filterArgs})
+		imageSize, err := container.GetImageSize(container.GetWholeImageName())
 		if err != nil {
 			container.SoftwareOrder.WriteLog(true, "Unable to connect to Docker client for image build sizes")
 		}
-		imageSize := imageInfo[0].Size
 		container.SoftwareOrder.TotalBuildSize += imageSize
 		container.ImageSize = imageSize
+		if container.SoftwareOrder.StripBuildTools || container.SoftwareOrder.Squash {
+			if err := container.RemoveReferenceImage(); err != nil {
+				container.SoftwareOrder.WriteLog(true, "Unable to remove the reference image "+container.GetReferenceImageName()+": "+err.Error())
+			}
+		}
 
 		// Push
 		container.PushStart = time.Now()
@@ -659,6 +945,11 @@ func getProgrammingOnlySingleContainer(order *SoftwareOrder) error {
 		SoftwareOrder: order,
 		BaseImage:     order.BaseImage,
 	}
+	platform, err := order.DetectPlatform(order.BaseImage)
+	if err != nil {
+		return err
+	}
+	container.Platform = platform
 
 	dockerConnection, err := client.NewClientWithOpts(client.WithVersion(DockerAPIVersion))
 	if err != nil {
@@ -694,8 +985,8 @@ func getProgrammingOnlySingleContainer(order *SoftwareOrder) error {
 	}
 
 	// Add files from the addons directory to the build context
-	for _, addon := range order.AddOns {
-		err := container.AddDirectoryToContext(addon, "", "")
+	for _, addon := range order.AddonConfigs {
+		err := container.AddAddonToContext(addon)
 		if err != nil {
 			return errors.New("Unable to place addon files into Docker context. " + err.Error())
 		}
@@ -710,6 +1001,31 @@ func getProgrammingOnlySingleContainer(order *SoftwareOrder) error {
 	if err != nil {
 		return err
 	}
+
+	// Add the --repositories right after the FROM so every package install uses them
+	repositories, err := RepositoryFiles(order.Repositories)
+	if err != nil {
+		return err
+	}
+	if len(repositories) > 0 {
+		copyRepositories := "COPY"
+		for _, repository := range repositories {
+			err = container.AddFileToContext(filepath.Join(order.Repositories, repository), "repositories/"+repository, []byte{})
+			if err != nil {
+				return err
+			}
+			copyRepositories += " repositories/" + repository
+		}
+		copyRepositories += " " + container.Platform.RepositoryPath
+		dockerfile = strings.Replace(dockerfile, "\nFROM $BASE\n", "\nFROM $BASE\n"+copyRepositories+"\n", 1)
+	}
+	for _, label := range container.GetProvenanceLabels() {
+		dockerfile += fmt.Sprintf("\nLABEL %s=\"%s\"", label.Name, label.Value)
+	}
+	for _, label := range container.GetLabels() {
+		name, value := splitKeyValue(label, "=")
+		dockerfile += fmt.Sprintf("\nLABEL %s=\"%s\"", name, value)
+	}
 	err = container.AddFileToContext("", "Dockerfile", []byte(dockerfile))
 	if err != nil {
 		return err
@@ -727,7 +1043,7 @@ func getProgrammingOnlySingleContainer(order *SoftwareOrder) error {
 // Build starts each container build concurrently and report the results
 func (order *SoftwareOrder) Build() error {
 	// Handle single container build and output of docker run instructions
-	if order.DeploymentType == "single" {
+	if order.Deployment.SingleContainer {
 		err := getProgrammingOnlySingleContainer(order)
 		if err != nil {
 			return err
@@ -921,13 +1237,50 @@ func (order *SoftwareOrder) LoadDocker(progress chan string, fail chan string, d
 	// Pull the base image depending on what the argument was
 	progress <- "Pulling base container image '" + order.BaseImage + "'" + " ..."
 	order.BuildContext = context.Background()
-	_, err = order.DockerClient.ImagePull(order.BuildContext, order.BaseImage, types.ImagePullOptions{})
+	pullResponse, err := order.DockerClient.ImagePull(order.BuildContext, order.BaseImage, types.ImagePullOptions{})
+	if err != nil {
+		fail <- err.Error()
+		return
+	}
+	_, err = io.Copy(ioutil.Discard, pullResponse)
+	pullResponse.Close()
 	if err != nil {
 		fail <- err.Error()
 		return
 	}
-
 	progress <- "Finished pulling base container image '" + order.BaseImage + "'"
+
+	// Detect the platform from the base image's /etc/os-release instead of its name
+	platform, err := order.DetectPlatform(order.BaseImage)
+	if err != nil {
+		fail <- err.Error()
+		return
+	}
+	order.Platform = platform.Name
+
+	// Squashing an image is an experimental feature of the Docker daemon
+	if order.Squash {
+		ping, err := order.DockerClient.Ping(order.BuildContext)
+		if err != nil {
+			fail <- err.Error()
+			return
+		}
+		if !ping.Experimental {
+			fail <- "The '--squash' argument requires the Docker daemon to run with experimental features enabled. Add \"experimental\": true to /etc/docker/daemon.json and restart the Docker service."
+			return
+		}
+	}
+
+	// A mirror is optional, except in the case of using a suse base image for single container
+	if len(order.MirrorURL) == 0 && order.Deployment.SingleContainer && order.Platform == "suse" {
+		fail <- "a --mirror-url argument is required for a base suse single container"
+		return
+	}
+	if order.Deployment.SingleContainer && platform.PackageManager == "dnf" {
+		fail <- fmt.Sprintf("The base image %s has %s, which is only supported by the deployment types that build an image for each container",
+			order.BaseImage, platform.OSRelease)
+		return
+	}
 	done <- 1
 }
 
@@ -981,7 +1334,7 @@ func (order *SoftwareOrder) TestMirror(progress chan string, fail chan string, d
 // TestRegistry runs a simple curl on the registry to see if it's accessible.
 // This is a preliminary check so an error is less likely to occur after the build, once the built images are being pushed
 func (order *SoftwareOrder) TestRegistry(progress chan string, fail chan string, done chan int) {
-	if order.DeploymentType == "single" {
+	if order.Deployment.SingleContainer {
 		// Single container deployment does not use a registry so skip this
 		done <- 1
 		return
@@ -1098,8 +1451,8 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 	generatePlaybookCommand := fmt.Sprintf(
 		"util/sas-orchestration build --input %s --output %ssas_viya_playbook.tgz --repository-warehouse %s",
 		order.SOEZipPath, order.BuildPath, order.MirrorURL)
-	if order.DeploymentType == "multiple" {
-		generatePlaybookCommand += " --deployment-type programming"
+	if len(order.Deployment.OrchestrationFlags) > 0 {
+		generatePlaybookCommand += " " + order.Deployment.OrchestrationFlags
 	}
 	
 	// The following is to fully provide the output of anything that goes wrong
@@ -1144,7 +1497,7 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 
 	// Detect if Ansible is installed.
 	// This is required for the Generate Manifests function in multiple and full deployment types, not in the single container.
-	if order.DeploymentType != "single" {
+	if !order.Deployment.SingleContainer {
 		testAnsibleInstall := "ansible --version"
 		_, err = exec.Command("sh", "-c", testAnsibleInstall).Output()
 		if err != nil {
@@ -1213,7 +1566,7 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 // Prepare concurrently loads all container's configurations if the container is staged to be built
 func (order *SoftwareOrder) Prepare() error {
 	// Ignore this in the single container
-	if order.DeploymentType == "single" {
+	if order.Deployment.SingleContainer {
 		return nil
 	}
 
@@ -1338,6 +1691,38 @@ func (order *SoftwareOrder) GenerateManifests() error {
 				volumes += " []\n"
 			}
 
+			// Files section. Each file is copied to the build directory so the manifests
+			// can be re-generated with --generate-manifests-only.
+			files := ""
+			if len(container.Config.Files) > 0 {
+				files += "    files:\n"
+				for _, file := range container.Config.Files {
+					source := "files/" + container.Name + "/" + file.Name
+					content, err := ioutil.ReadFile(file.Source)
+					if err != nil {
+						return err
+					}
+					if err := os.MkdirAll(filepath.Dir(order.BuildPath+source), 0744); err != nil {
+						return err
+					}
+					if err := ioutil.WriteFile(order.BuildPath+source, content, 0600); err != nil {
+						return err
+					}
+					files += fmt.Sprintf("    - name: %s\n      source: %s\n      mount_path: %s\n      secret: %t\n      mode: %d\n",
+						strconv.Quote(file.Name), strconv.Quote(source), strconv.Quote(file.MountPath), file.Secret, file.Mode)
+				}
+			}
+
+			// Healthcheck and user sections, which the manifests use for the probes and the securityContext
+			runtimeSettings := ""
+			if check := container.Config.Healthcheck; len(check.Command) > 0 {
+				runtimeSettings += fmt.Sprintf("    healthcheck:\n      command: %s\n      interval: %d\n      timeout: %d\n      start_period: %d\n      retries: %d\n",
+					strconv.Quote(check.Command), check.Interval, check.Timeout, check.StartPeriod, check.Retries)
+			}
+			if len(container.Config.User) > 0 {
+				runtimeSettings += "    user: " + strconv.Quote(container.Config.User) + "\n"
+			}
+
 			// Resources section
 			resources := ""
 			if len(container.Config.Resources.Limits) > 0 && len(container.Config.Resources.Requests) > 0 {
@@ -1362,6 +1747,8 @@ func (order *SoftwareOrder) GenerateManifests() error {
 			containerSection += environment
 			containerSection += secrets
 			containerSection += volumes
+			containerSection += files
+			containerSection += runtimeSettings
 			containerSection += resources
 			containerVarSections = append(containerVarSections, containerSection)
 		}
@@ -1453,11 +1840,11 @@ settings:
   - manifest-vars.yml
 
   roles:
-  - ../../util/static-roles-%s/manifests
+  - ../../%s
 ...
 `
 		err = ioutil.WriteFile(order.BuildPath+"generate_manifests.yml",
-			[]byte(fmt.Sprintf(playbook, order.TagOverride, order.DeploymentType)), 0755)
+			[]byte(fmt.Sprintf(playbook, order.TagOverride, order.Deployment.ManifestRole)), 0755)
 		if err != nil {
 			return err
 		}
@@ -1474,6 +1861,33 @@ settings:
 		return errors.New(result)
 	}
 
+	// Catch manifest problems before `kubectl apply` does
+	if !order.SkipSchemaValidation {
+		if err := order.ValidateManifests(); err != nil {
+			return err
+		}
+	}
+
+	// Small deployment types such as multiple can also run with docker compose
+	if order.Deployment.Compose {
+		if err := order.GenerateCompose(); err != nil {
+			return err
+		}
+	}
+
+	for _, format := range order.ManifestFormats {
+		if format == "helm" {
+			if err := order.GenerateHelmChart(); err != nil {
+				return err
+			}
+		}
+		if format == "kustomize" {
+			if err := order.GenerateKustomize(); err != nil {
+				return err
+			}
+		}
+	}
+
 	order.WriteLog(true, "Finished creating deployment manifests\n")
 
 	return nil
@@ -1495,7 +1909,7 @@ func (order *SoftwareOrder) LoadUsermods(progress chan string, fail chan string,
 	}
 
 	// Workaround for single container always requiring this variable somewhere in the usermods
-	if order.DeploymentType == "single" {
+	if order.Deployment.SingleContainer {
 		input = []byte(string(input) + "\nrecipe_override: True\n")
 	}
 
@@ -1563,7 +1977,19 @@ func bytesToGB(bytes int64) string {
 
 // ShowSummary displays metrics and next steps for deployment
 func (order *SoftwareOrder) ShowSummary() error {
-	if order.DeploymentType == "single" {
+	// List what each addon added to the images
+	if addonSummary := order.AddonSummary(); len(addonSummary) > 0 {
+		fmt.Println("\n" + addonSummary)
+		order.WriteLog(false, addonSummary)
+	}
+
+	// List the problems that were found in the generated Dockerfiles
+	if lintSummary := order.LintSummary(); len(lintSummary) > 0 {
+		fmt.Println("\n" + lintSummary)
+		order.WriteLog(false, lintSummary)
+	}
+
+	if order.Deployment.SingleContainer {
 
 		// TODO: this does not use the Fully Qualified Domain Name
 		hostname, err := os.Hostname()
@@ -1599,6 +2025,13 @@ sas-viya-single-programming-only:%s
 					bytesToGB(container.ImageSize),
 					container.BuildEnd.Sub(container.BuildStart).Round(time.Second),
 					container.PushEnd.Sub(container.PushStart).Round(time.Second))
+				if container.ReferenceSize > 0 {
+					output += fmt.Sprintf("\tSaved: %s of %s", bytesToGB(container.ReferenceSize-container.ImageSize),
+						bytesToGB(container.ReferenceSize))
+				}
+				if container.SBOMPackages > 0 {
+					output += fmt.Sprintf("\tSBOM: %d packages", container.SBOMPackages)
+				}
 				fmt.Println(output)
 				order.WriteLog(false, output)
 			}
@@ -1664,5 +2097,46 @@ kubectl -n %s apply -f %s/kubernetes/deployments
 	order.WriteLog(false, manifestLocation)
 	order.WriteLog(false, manifestInstructions)
 
+	if order.Deployment.Compose {
+		composeInstructions := fmt.Sprintf(`
+A docker-compose.yml has been created: %s/compose/docker-compose.yml
+
+To run the deployment on a single host without Kubernetes run the below command
+
+docker compose -f %s/compose/docker-compose.yml up -d
+`,
+			symlinkBuildPath, symlinkBuildPath)
+		fmt.Println(composeInstructions)
+		order.WriteLog(false, composeInstructions)
+	}
+
+	for _, format := range order.ManifestFormats {
+		if format == "helm" {
+			helmInstructions := fmt.Sprintf(`
+A Helm chart has been created: %s/helm/%s
+
+To install or upgrade the deployment with Helm run the below command
+
+helm upgrade --install %s %s/helm/%s --namespace %s
+`,
+				symlinkBuildPath, order.ProjectName,
+				order.ProjectName, symlinkBuildPath, order.ProjectName, kubeNamespace)
+			fmt.Println(helmInstructions)
+			order.WriteLog(false, helmInstructions)
+		}
+		if format == "kustomize" {
+			kustomizeInstructions := fmt.Sprintf(`
+A kustomize base and overlays have been created: %s/kustomize/
+
+To deploy an environment with its overlay run the below command
+
+kubectl apply -k %s/kustomize/overlays/<environment>
+`,
+				symlinkBuildPath, symlinkBuildPath)
+			fmt.Println(kustomizeInstructions)
+			order.WriteLog(false, kustomizeInstructions)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,303 @@
+// platform.go
+// Detects the Linux distribution of a base image from its /etc/os-release
+// file, so the images are built with the package manager of the base image
+// instead of guessing from the image name, and unsupported base images are
+// refused before any image is built.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// PlatformDefinition is a Linux distribution that the images can be built on
+type PlatformDefinition struct {
+	Name            string   // The PLATFORM build argument: redhat or suse
+	PackageManager  string   // The PACKAGE_MANAGER build argument: yum, dnf, or zypper
+	IDs             []string // The ID or ID_LIKE values of /etc/os-release that match
+	Versions        []string // The major VERSION_ID values that match
+	Description     string
+	ModuleStreams   []string // The dnf module streams that are enabled before Ansible is installed
+	Repositories    []string // The packages that add the public repositories that Ansible is installed from, unless --repositories are given
+	AnsiblePackages string   // The packages that are needed to run the Ansible roles
+	Config          string   // The package manager's config file, which is given a longer timeout for slow mirrors
+	RepositoryPath  string   // The directory that the --repositories files are added to
+	Cache           string   // The directories that are removed after the packages are installed
+	OSRelease       string   // The PRETTY_NAME of the base image that was detected
+	BaseDigest      string   // The digest of the base image, such as sha256:0a1b, for the org.opencontainers.image.base.digest label
+}
+
+// The distributions that the Ansible roles and the addons support
+var supportedPlatforms = []PlatformDefinition{
+	{
+		Name:            "redhat",
+		PackageManager:  "yum",
+		IDs:             []string{"rhel", "centos", "ol"},
+		Versions:        []string{"7"},
+		Description:     "Red Hat Enterprise Linux 7 or CentOS 7",
+		AnsiblePackages: "ansible",
+		Config:          "/etc/yum.conf",
+		RepositoryPath:  "/etc/yum.repos.d/",
+		Cache:           "/root/.cache /var/cache/yum",
+	},
+	// Ansible is installed from EPEL since UBI 8 images do not include the epel-release package in their repositories.
+	// With --repositories the EPEL package is not installed, so the repositories must provide Ansible.
+	{
+		Name:            "redhat",
+		PackageManager:  "dnf",
+		IDs:             []string{"rhel", "centos", "ol"},
+		Versions:        []string{"8"},
+		Description:     "Red Hat Enterprise Linux 8, UBI 8, or Rocky Linux 8",
+		ModuleStreams:   []string{"python36"},
+		Repositories:    []string{"https://dl.fedoraproject.org/pub/epel/epel-release-latest-8.noarch.rpm"},
+		AnsiblePackages: "python3 ansible",
+		Config:          "/etc/dnf/dnf.conf",
+		RepositoryPath:  "/etc/yum.repos.d/",
+		Cache:           "/root/.cache /var/cache/dnf",
+	},
+	{
+		Name:            "suse",
+		PackageManager:  "zypper",
+		IDs:             []string{"suse", "sles", "opensuse", "opensuse-leap"},
+		Versions:        []string{"12", "15", "42"},
+		Description:     "SUSE Linux Enterprise Server 12 or 15, or openSUSE Leap",
+		AnsiblePackages: "ansible curl",
+		RepositoryPath:  "/etc/zypp/repos.d/",
+		Cache:           "/var/cache/zypp",
+	},
+}
+
+// Install returns the command that installs packages without a prompt
+func (platform PlatformDefinition) Install(packages string) string {
+	if platform.PackageManager == "zypper" {
+		return "zypper install --no-confirm " + packages
+	}
+	return platform.PackageManager + " install --assumeyes " + packages
+}
+
+// Remove returns the command that removes packages without a prompt
+func (platform PlatformDefinition) Remove(packages string) string {
+	if platform.PackageManager == "zypper" {
+		return "zypper remove --no-confirm " + packages
+	}
+	return platform.PackageManager + " remove --assumeyes " + packages
+}
+
+// EnableModule returns the command that enables a dnf module stream, such as python36
+func (platform PlatformDefinition) EnableModule(stream string) string {
+	return platform.PackageManager + " module enable --assumeyes " + stream
+}
+
+// Clean returns the command that removes the package manager's cache from the layer
+func (platform PlatformDefinition) Clean() string {
+	clean := "rm -rf " + platform.Cache
+	if platform.PackageManager == "dnf" {
+		clean = "dnf clean all && " + clean
+	}
+	return clean
+}
+
+// The containers are pre-built at the same time, so they wait for each other to detect the platform of a base image
+var platformLock sync.Mutex
+
+// Docker's predefined build arguments for a proxy. They are not kept in the image's history
+// unless a Dockerfile declares them with ARG, so they are passed to the build but never declared.
+var proxyBuildArgs = []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"}
+
+// RepositoryFiles returns the names of the .repo files in the --repositories directory
+func RepositoryFiles(directory string) ([]string, error) {
+	if len(directory) == 0 {
+		return []string{}, nil
+	}
+	paths, err := filepath.Glob(strings.TrimSuffix(directory, "/") + "/*.repo")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// The files that hold the os-release of a base image, in the order they are read
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// parseOSRelease reads the KEY=value lines of an os-release file
+func parseOSRelease(content string) map[string]string {
+	release := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || !strings.Contains(line, "=") {
+			continue
+		}
+		key, value := splitKeyValue(line, "=")
+		release[key] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return release
+}
+
+// MatchPlatform returns the supported platform of an os-release, or an error with the supported platforms
+func MatchPlatform(release map[string]string) (PlatformDefinition, error) {
+	ids := append([]string{release["ID"]}, strings.Fields(release["ID_LIKE"])...)
+	version := strings.Split(release["VERSION_ID"], ".")[0]
+	name := release["PRETTY_NAME"]
+	if name == "" {
+		name = strings.TrimSpace(release["ID"] + " " + release["VERSION_ID"])
+	}
+
+	descriptions := []string{}
+	for _, platform := range supportedPlatforms {
+		descriptions = append(descriptions, platform.Description)
+		if !stringInSlice(version, platform.Versions) {
+			continue
+		}
+		for _, id := range ids {
+			if stringInSlice(id, platform.IDs) {
+				platform.OSRelease = name
+				return platform, nil
+			}
+		}
+	}
+	if name == "" {
+		name = "an unknown distribution"
+	}
+	return PlatformDefinition{}, fmt.Errorf("%s is not supported: choose a base image with %s", name, strings.Join(descriptions, "; "))
+}
+
+// readImageFile reads a file from an image by creating a container that is never started.
+// A symbolic link, such as /etc/os-release on CentOS, is followed.
+func readImageFile(dockerClient *client.Client, image string, filePath string) ([]byte, error) {
+	ctx := context.Background()
+	created, err := dockerClient.ContainerCreate(ctx, &dockercontainer.Config{Image: image, Cmd: []string{"true"}}, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer dockerClient.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+	return readContainerFile(dockerClient, created.ID, filePath)
+}
+
+// readContainerFile reads a file from a container that is created or stopped.
+// A symbolic link is followed.
+func readContainerFile(dockerClient *client.Client, containerID string, filePath string) ([]byte, error) {
+	ctx := context.Background()
+	stat, err := dockerClient.ContainerStatPath(ctx, containerID, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(stat.LinkTarget) > 0 {
+		filePath = stat.LinkTarget
+	}
+	reader, _, err := dockerClient.CopyFromContainer(ctx, containerID, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// The file is returned in a tar stream
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg && header.Name == path.Base(filePath) {
+			return ioutil.ReadAll(tarReader)
+		}
+	}
+	return nil, fmt.Errorf("%s is not a file", filePath)
+}
+
+// DetectPlatform inspects the os-release of a base image to find its platform.
+// The image is pulled if it is not present, and the result is kept for the other containers with the same base image.
+func (order *SoftwareOrder) DetectPlatform(image string) (PlatformDefinition, error) {
+	platformLock.Lock()
+	defer platformLock.Unlock()
+	if platform, found := order.Platforms[image]; found {
+		return platform, nil
+	}
+
+	dockerClient, err := client.NewClientWithOpts(client.WithVersion(DockerAPIVersion))
+	if err != nil {
+		return PlatformDefinition{}, err
+	}
+	inspect, _, err := dockerClient.ImageInspectWithRaw(context.Background(), image)
+	if client.IsErrNotFound(err) {
+		order.WriteLog(true, "Pulling base container image '"+image+"' ...")
+		response, err := dockerClient.ImagePull(context.Background(), image, types.ImagePullOptions{})
+		if err != nil {
+			return PlatformDefinition{}, err
+		}
+		_, err = io.Copy(ioutil.Discard, response)
+		response.Close()
+		if err != nil {
+			return PlatformDefinition{}, err
+		}
+		inspect, _, err = dockerClient.ImageInspectWithRaw(context.Background(), image)
+	}
+	if err != nil {
+		return PlatformDefinition{}, err
+	}
+
+	content := []byte{}
+	for _, osReleasePath := range osReleasePaths {
+		if content, err = readImageFile(dockerClient, image, osReleasePath); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return PlatformDefinition{}, fmt.Errorf("Unable to find the platform of the base image %s: it does not have an os-release file, %s",
+			image, err.Error())
+	}
+	platform, err := MatchPlatform(parseOSRelease(string(content)))
+	if err != nil {
+		return PlatformDefinition{}, fmt.Errorf("Unsupported base image %s: %s", image, err.Error())
+	}
+
+	// The repository digest identifies the pulled image in its registry. A local image only has its ID.
+	platform.BaseDigest = inspect.ID
+	if len(inspect.RepoDigests) > 0 {
+		_, platform.BaseDigest = splitKeyValue(inspect.RepoDigests[0], "@")
+	}
+
+	if order.Platforms == nil {
+		order.Platforms = make(map[string]PlatformDefinition)
+	}
+	order.Platforms[image] = platform
+	order.WriteLog(true, fmt.Sprintf("Detected %s (%s with %s) in the base image %s",
+		platform.OSRelease, platform.Name, platform.PackageManager, image))
+	return platform, nil
+}
@@ -0,0 +1,267 @@
+// provenance.go
+// Adds the Open Container Initiative (OCI) image labels, with the software
+// order and the roles and addons of each image, and writes a provenance
+// document for each image that records the inputs of its build and their
+// digests, in the SLSA provenance format.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecipeSource is the project that the images are built with, see the org.opencontainers.image.source label
+const RecipeSource = "https://github.com/sassoftware/sas-container-recipes"
+
+// ProvenanceFileName is written to each container's build directory
+const ProvenanceFileName = "provenance.json"
+
+// The formats of the provenance document, see https://slsa.dev/provenance/v0.2
+const (
+	provenanceStatementType = "https://in-toto.io/Statement/v0.1"
+	provenancePredicateType = "https://slsa.dev/provenance/v0.2"
+	provenanceBuildType     = RecipeSource + "/build@v1"
+)
+
+// ProvenanceStatement is the provenance document of an image
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// ProvenanceSubject is the image that the document describes
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenancePredicate is how the image was built and what it was built from
+type ProvenancePredicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation ProvenanceInvocation `json:"invocation"`
+	Metadata   ProvenanceMetadata   `json:"metadata"`
+	Materials  []ProvenanceMaterial `json:"materials"`
+}
+
+// ProvenanceInvocation is the version of this project and the arguments that the image was built with
+type ProvenanceInvocation struct {
+	ConfigSource ProvenanceMaterial     `json:"configSource"`
+	Parameters   map[string]interface{} `json:"parameters"`
+}
+
+// ProvenanceMetadata is when the image was built
+type ProvenanceMetadata struct {
+	BuildInvocationID string `json:"buildInvocationId"`
+	BuildStartedOn    string `json:"buildStartedOn"`
+	BuildFinishedOn   string `json:"buildFinishedOn"`
+	Reproducible      bool   `json:"reproducible"`
+}
+
+// ProvenanceMaterial is an input of the build, such as the base image or a file of the Docker context
+type ProvenanceMaterial struct {
+	URI        string            `json:"uri"`
+	Digest     map[string]string `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint,omitempty"`
+}
+
+// sha256Digest returns the hex sha256 digest of the content
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileDigest returns the hex sha256 digest of a file without reading it all into memory
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// splitDigest splits an image digest such as sha256:0a1b into its algorithm and value
+func splitDigest(digest string) map[string]string {
+	algorithm, value := splitKeyValue(digest, ":")
+	if value == "" {
+		return nil
+	}
+	return map[string]string{algorithm: value}
+}
+
+// GetAddonNames returns the names of the addons that add lines to the container's Dockerfile.
+// The single image is listed by its whole name in the addon_config.yml files, see container.GetName.
+func (container *Container) GetAddonNames() []string {
+	names := []string{}
+	for _, addon := range container.SoftwareOrder.AddonConfigs {
+		_, found := addon.Images[container.Name]
+		if _, foundWhole := addon.Images[container.GetName()]; found || foundWhole {
+			names = append(names, addon.Name)
+		}
+	}
+	return names
+}
+
+// GetProvenanceLabels returns the OCI labels of the image, with the software order and the roles and addons of the image
+func (container *Container) GetProvenanceLabels() []DockerfileLabel {
+	order := container.SoftwareOrder
+	labels := []DockerfileLabel{
+		{Name: "org.opencontainers.image.created", Value: order.StartTime.UTC().Format(time.RFC3339)},
+		{Name: "org.opencontainers.image.version", Value: container.GetTag()},
+		{Name: "org.opencontainers.image.source", Value: RecipeSource},
+	}
+	if len(order.SourceRevision) > 0 {
+		labels = append(labels, DockerfileLabel{Name: "org.opencontainers.image.revision", Value: order.SourceRevision})
+	}
+	labels = append(labels, DockerfileLabel{Name: "org.opencontainers.image.base.name", Value: container.BaseImage})
+	if len(container.Platform.BaseDigest) > 0 {
+		labels = append(labels, DockerfileLabel{Name: "org.opencontainers.image.base.digest", Value: container.Platform.BaseDigest})
+	}
+	// The order.oom of older software orders does not record the order number and release
+	if len(order.OrderOOM.OrderNumber) > 0 {
+		labels = append(labels, DockerfileLabel{Name: "sas.order.number", Value: order.OrderOOM.OrderNumber})
+	}
+	if len(order.OrderOOM.Release) > 0 {
+		labels = append(labels, DockerfileLabel{Name: "sas.viya.version", Value: order.OrderOOM.Release})
+	}
+	if len(container.Config.Roles) > 0 {
+		labels = append(labels, DockerfileLabel{Name: "sas.recipe.roles", Value: strings.Join(container.Config.Roles, ",")})
+	}
+	if addons := container.GetAddonNames(); len(addons) > 0 {
+		labels = append(labels, DockerfileLabel{Name: "sas.recipe.addon.list", Value: strings.Join(addons, ",")})
+	}
+	return labels
+}
+
+// GetProvenance returns the provenance document of the built image.
+// The materials are the base image, the software order, and each file of the Docker context.
+func (container *Container) GetProvenance() (ProvenanceStatement, error) {
+	order := container.SoftwareOrder
+	inspect, _, err := container.DockerClient.ImageInspectWithRaw(order.BuildContext, container.GetWholeImageName())
+	if err != nil {
+		return ProvenanceStatement{}, err
+	}
+
+	statement := ProvenanceStatement{
+		Type: provenanceStatementType,
+		Subject: []ProvenanceSubject{
+			{Name: container.GetWholeImageName(), Digest: splitDigest(inspect.ID)},
+		},
+		PredicateType: provenancePredicateType,
+	}
+	predicate := &statement.Predicate
+	predicate.Builder.ID = RecipeSource + "@v" + RecipeVersion
+	predicate.BuildType = provenanceBuildType
+
+	predicate.Invocation.ConfigSource = ProvenanceMaterial{URI: "git+" + RecipeSource, EntryPoint: "build.sh"}
+	if len(order.SourceRevision) > 0 {
+		predicate.Invocation.ConfigSource.Digest = map[string]string{"sha1": order.SourceRevision}
+	}
+
+	// The names of the build arguments are kept but not their values, which can have a password
+	buildArgs := []string{}
+	for buildArg := range container.BuildArgs {
+		buildArgs = append(buildArgs, buildArg)
+	}
+	sort.Strings(buildArgs)
+	predicate.Invocation.Parameters = map[string]interface{}{
+		"type":            order.DeploymentType,
+		"projectName":     order.ProjectName,
+		"tag":             container.GetTag(),
+		"baseImage":       container.BaseImage,
+		"platform":        container.Platform.Name,
+		"packageManager":  container.Platform.PackageManager,
+		"mirrorURL":       order.MirrorURL,
+		"roles":           container.Config.Roles,
+		"addons":          container.GetAddonNames(),
+		"buildArgs":       buildArgs,
+		"labels":          container.GetLabels(),
+		"stripBuildTools": order.StripBuildTools,
+		"squash":          order.Squash,
+	}
+
+	predicate.Metadata = ProvenanceMetadata{
+		BuildInvocationID: order.TimestampTag,
+		BuildStartedOn:    container.BuildStart.UTC().Format(time.RFC3339),
+		BuildFinishedOn:   container.BuildEnd.UTC().Format(time.RFC3339),
+	}
+
+	base := ProvenanceMaterial{URI: "docker://" + container.BaseImage}
+	if len(container.Platform.BaseDigest) > 0 {
+		base.Digest = splitDigest(container.Platform.BaseDigest)
+	}
+	predicate.Materials = append(predicate.Materials, base)
+	if len(order.SOEZipPath) > 0 {
+		digest, err := fileDigest(order.SOEZipPath)
+		if err != nil {
+			return ProvenanceStatement{}, err
+		}
+		predicate.Materials = append(predicate.Materials, ProvenanceMaterial{
+			URI:    "file:" + filepath.Base(order.SOEZipPath),
+			Digest: map[string]string{"sha256": digest},
+		})
+	}
+	contextPaths := []string{}
+	for contextPath := range container.ContextDigests {
+		contextPaths = append(contextPaths, contextPath)
+	}
+	sort.Strings(contextPaths)
+	for _, contextPath := range contextPaths {
+		predicate.Materials = append(predicate.Materials, ProvenanceMaterial{
+			URI:    "file:" + contextPath,
+			Digest: map[string]string{"sha256": container.ContextDigests[contextPath]},
+		})
+	}
+	return statement, nil
+}
+
+// WriteProvenance writes the provenance document of the built image to the container's build directory
+func (container *Container) WriteProvenance() error {
+	statement, err := container.GetProvenance()
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(container.BuildPath, ProvenanceFileName)
+	if err := ioutil.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	container.WriteLog("Wrote the provenance of the image to " + path)
+	return nil
+}
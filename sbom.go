@@ -0,0 +1,475 @@
+// sbom.go
+// Creates a software bill of materials (SBOM) for each built image. The image
+// is run with a script that lists the installed RPM packages and the Python
+// packages, such as the packages of the ide-jupyter-python3 addon. The SAS
+// packages are the RPM packages from SAS. The SBOM is written in the SPDX and
+// CycloneDX JSON formats to the container's build directory.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+)
+
+// The files of the SBOM in each container's build directory
+const (
+	SPDXFileName      = "sbom.spdx.json"
+	CycloneDXFileName = "sbom.cdx.json"
+)
+
+// The file that sbomInventoryScript writes in the image
+const sbomInventoryPath = "/tmp/sbom-inventory.txt"
+
+// sbomInventoryScript lists a tab separated line for each package of the image.
+// Each pip is asked since an addon can install its packages with a different Python than the base image.
+const sbomInventoryScript = `rpm -qa --queryformat 'rpm\t%{NAME}\t%{EPOCH}\t%{VERSION}\t%{RELEASE}\t%{ARCH}\t%{LICENSE}\t%{VENDOR}\t%{SUMMARY}\n' > ` + sbomInventoryPath + ` || exit 1
+for pip in pip3 pip2 pip; do
+    if command -v $pip > /dev/null 2>&1; then
+        ($pip freeze --all 2> /dev/null || $pip freeze 2> /dev/null) | while read -r line; do
+            printf 'python\t%s\n' "$line" >> ` + sbomInventoryPath + `
+        done
+    fi
+done`
+
+// The SBOM labels that --sbom-label adds to the image
+const (
+	SBOMLabel         = "sas.sbom"          // The CycloneDX JSON, compressed with gzip and encoded with base64
+	SBOMFormatLabel   = "sas.sbom.format"   // CycloneDX-1.4
+	SBOMChecksumLabel = "sas.sbom.sha256"   // The sha256 digest of the CycloneDX JSON before it is compressed
+	SBOMEncodingLabel = "sas.sbom.encoding" // gzip+base64
+)
+
+// SBOMPackage is a package that is installed in an image
+type SBOMPackage struct {
+	Type    string // rpm or python
+	Name    string
+	Epoch   string
+	Version string
+	Release string
+	Arch    string
+	License string
+	Vendor  string
+	Summary string
+	SAS     bool // A package from SAS, see isSASPackage
+}
+
+// isSASPackage reports if a RPM package is from SAS, which are named sas-* and have the SAS vendor
+func isSASPackage(name string, vendor string) bool {
+	return strings.HasPrefix(name, "sas-") || strings.Contains(vendor, "SAS Institute")
+}
+
+// FullVersion returns the version of the package with its release, such as 2.8.5-1.el7
+func (pkg SBOMPackage) FullVersion() string {
+	if len(pkg.Release) > 0 {
+		return pkg.Version + "-" + pkg.Release
+	}
+	return pkg.Version
+}
+
+// PackageURL returns the package URL of the package, see https://github.com/package-url/purl-spec
+func (pkg SBOMPackage) PackageURL(platform string) string {
+	if pkg.Type == "python" {
+		return fmt.Sprintf("pkg:pypi/%s@%s", strings.ToLower(pkg.Name), pkg.Version)
+	}
+	namespace := platform
+	if pkg.SAS {
+		namespace = "sas"
+	}
+	qualifiers := []string{}
+	if len(pkg.Arch) > 0 {
+		qualifiers = append(qualifiers, "arch="+pkg.Arch)
+	}
+	if len(pkg.Epoch) > 0 {
+		qualifiers = append(qualifiers, "epoch="+pkg.Epoch)
+	}
+	purl := fmt.Sprintf("pkg:rpm/%s/%s@%s", namespace, pkg.Name, pkg.FullVersion())
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+// parseSBOMInventory parses the lines of sbomInventoryScript.
+// The packages are sorted by type and name, and a Python package that more than one pip lists is kept once.
+func parseSBOMInventory(content string) []SBOMPackage {
+	packages := []SBOMPackage{}
+	found := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		var pkg SBOMPackage
+		switch {
+		case fields[0] == "rpm" && len(fields) == 9:
+			pkg = SBOMPackage{Type: "rpm", Name: fields[1], Epoch: fields[2], Version: fields[3], Release: fields[4],
+				Arch: fields[5], License: fields[6], Vendor: fields[7], Summary: fields[8]}
+			// rpm prints (none) for the tags that a package does not have
+			for _, value := range []*string{&pkg.Epoch, &pkg.Arch, &pkg.License, &pkg.Vendor, &pkg.Summary} {
+				if *value == "(none)" {
+					*value = ""
+				}
+			}
+			pkg.SAS = isSASPackage(pkg.Name, pkg.Vendor)
+		case fields[0] == "python" && len(fields) == 2:
+			// Only the name==version lines, not editable installs or comments
+			name, version := splitKeyValue(fields[1], "==")
+			if name == "" || version == "" {
+				continue
+			}
+			pkg = SBOMPackage{Type: "python", Name: name, Version: strings.TrimSpace(version)}
+		default:
+			continue
+		}
+		key := pkg.Type + ":" + strings.ToLower(pkg.Name) + "@" + pkg.FullVersion() + "." + pkg.Arch
+		if found[key] {
+			continue
+		}
+		found[key] = true
+		packages = append(packages, pkg)
+	}
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].Type != packages[j].Type {
+			return packages[i].Type < packages[j].Type
+		}
+		return strings.ToLower(packages[i].Name) < strings.ToLower(packages[j].Name)
+	})
+	return packages
+}
+
+// CollectPackages runs the built image with sbomInventoryScript instead of its entrypoint and returns its packages.
+// The container runs as root without a network and is removed afterwards.
+func (container *Container) CollectPackages() ([]SBOMPackage, error) {
+	ctx := container.SoftwareOrder.BuildContext
+	config := &dockercontainer.Config{
+		Image:           container.GetWholeImageName(),
+		User:            "root",
+		Entrypoint:      []string{"/bin/sh", "-c", sbomInventoryScript},
+		NetworkDisabled: true,
+	}
+	created, err := container.DockerClient.ContainerCreate(ctx, config, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer container.DockerClient.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err := container.DockerClient.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return nil, err
+	}
+	statusChannel, errorChannel := container.DockerClient.ContainerWait(ctx, created.ID, dockercontainer.WaitConditionNotRunning)
+	select {
+	case err := <-errorChannel:
+		return nil, err
+	case status := <-statusChannel:
+		if status.StatusCode != 0 {
+			return nil, fmt.Errorf("Unable to list the packages of %s: rpm exited with the status %d",
+				container.GetWholeImageName(), status.StatusCode)
+		}
+	}
+
+	content, err := readContainerFile(container.DockerClient, created.ID, sbomInventoryPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseSBOMInventory(string(content)), nil
+}
+
+// sbomSerialNumber returns a UUID for the SBOM of an image, which is the same each time the SBOM of the image is created
+func sbomSerialNumber(imageID string) string {
+	sum := sha256.Sum256([]byte(imageID))
+	sum[6] = (sum[6] & 0x0f) | 0x50 // Version 5, a name based UUID
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// CreateSPDX returns the SPDX 2.2 JSON document of the image's packages, see https://spdx.github.io/spdx-spec/v2.2.2/
+func (container *Container) CreateSPDX(packages []SBOMPackage, imageID string, created time.Time) ([]byte, error) {
+	type spdxExternalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	type spdxPackage struct {
+		Name             string            `json:"name"`
+		SPDXID           string            `json:"SPDXID"`
+		VersionInfo      string            `json:"versionInfo,omitempty"`
+		Supplier         string            `json:"supplier,omitempty"`
+		DownloadLocation string            `json:"downloadLocation"`
+		FilesAnalyzed    bool              `json:"filesAnalyzed"`
+		LicenseConcluded string            `json:"licenseConcluded"`
+		LicenseDeclared  string            `json:"licenseDeclared"`
+		LicenseComments  string            `json:"licenseComments,omitempty"`
+		CopyrightText    string            `json:"copyrightText"`
+		Summary          string            `json:"summary,omitempty"`
+		ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+	}
+	type spdxRelationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+	document := struct {
+		SPDXVersion       string `json:"spdxVersion"`
+		DataLicense       string `json:"dataLicense"`
+		SPDXID            string `json:"SPDXID"`
+		Name              string `json:"name"`
+		DocumentNamespace string `json:"documentNamespace"`
+		CreationInfo      struct {
+			Created  string   `json:"created"`
+			Creators []string `json:"creators"`
+		} `json:"creationInfo"`
+		Packages      []spdxPackage      `json:"packages"`
+		Relationships []spdxRelationship `json:"relationships"`
+	}{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              container.GetWholeImageName(),
+		DocumentNamespace: RecipeSource + "/spdx/" + container.GetName() + "-" + sbomSerialNumber(imageID),
+	}
+	document.CreationInfo.Created = created.UTC().Format(time.RFC3339)
+	document.CreationInfo.Creators = []string{"Tool: sas-container-recipes-" + RecipeVersion, "Organization: SAS Institute Inc."}
+
+	// The image is a package that contains the installed packages. The license of a RPM package is not
+	// always a SPDX license expression, so it is given as a comment.
+	document.Packages = append(document.Packages, spdxPackage{
+		Name:             container.GetName(),
+		SPDXID:           "SPDXRef-Image",
+		VersionInfo:      container.GetTag(),
+		Supplier:         "Organization: SAS Institute Inc.",
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+		ExternalRefs: []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl",
+			ReferenceLocator: "pkg:docker/" + container.GetName() + "@" + container.GetTag()}},
+	})
+	document.Relationships = append(document.Relationships, spdxRelationship{
+		SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Image"})
+	for index, pkg := range packages {
+		item := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%s-%d", pkg.Type, index+1),
+			VersionInfo:      pkg.FullVersion(),
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			LicenseComments:  pkg.License,
+			CopyrightText:    "NOASSERTION",
+			Summary:          pkg.Summary,
+			ExternalRefs: []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl",
+				ReferenceLocator: pkg.PackageURL(container.Platform.Name)}},
+		}
+		if pkg.SAS {
+			item.Supplier = "Organization: SAS Institute Inc."
+		} else if len(pkg.Vendor) > 0 {
+			item.Supplier = "Organization: " + pkg.Vendor
+		}
+		document.Packages = append(document.Packages, item)
+		document.Relationships = append(document.Relationships, spdxRelationship{
+			SPDXElementID: "SPDXRef-Image", RelationshipType: "CONTAINS", RelatedSPDXElement: item.SPDXID})
+	}
+	return json.MarshalIndent(document, "", "  ")
+}
+
+// CreateCycloneDX returns the CycloneDX 1.4 JSON document of the image's packages, see https://cyclonedx.org/docs/1.4/json/
+func (container *Container) CreateCycloneDX(packages []SBOMPackage, imageID string, created time.Time) ([]byte, error) {
+	type cdxLicense struct {
+		License struct {
+			Name string `json:"name"`
+		} `json:"license"`
+	}
+	type cdxProperty struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type cdxComponent struct {
+		Type        string        `json:"type"`
+		BOMRef      string        `json:"bom-ref"`
+		Name        string        `json:"name"`
+		Version     string        `json:"version,omitempty"`
+		Publisher   string        `json:"publisher,omitempty"`
+		Description string        `json:"description,omitempty"`
+		Licenses    []cdxLicense  `json:"licenses,omitempty"`
+		PURL        string        `json:"purl,omitempty"`
+		Properties  []cdxProperty `json:"properties,omitempty"`
+	}
+	type cdxTool struct {
+		Vendor  string `json:"vendor"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	document := struct {
+		BOMFormat    string `json:"bomFormat"`
+		SpecVersion  string `json:"specVersion"`
+		SerialNumber string `json:"serialNumber"`
+		Version      int    `json:"version"`
+		Metadata     struct {
+			Timestamp string       `json:"timestamp"`
+			Tools     []cdxTool    `json:"tools"`
+			Component cdxComponent `json:"component"`
+		} `json:"metadata"`
+		Components []cdxComponent `json:"components"`
+	}{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + sbomSerialNumber(imageID),
+		Version:      1,
+	}
+	document.Metadata.Timestamp = created.UTC().Format(time.RFC3339)
+	document.Metadata.Tools = []cdxTool{{Vendor: "SAS Institute Inc.", Name: "sas-container-recipes", Version: RecipeVersion}}
+	document.Metadata.Component = cdxComponent{
+		Type:      "container",
+		BOMRef:    "pkg:docker/" + container.GetName() + "@" + container.GetTag(),
+		Name:      container.GetName(),
+		Version:   container.GetTag(),
+		Publisher: "SAS Institute Inc.",
+		PURL:      "pkg:docker/" + container.GetName() + "@" + container.GetTag(),
+		Properties: []cdxProperty{
+			{Name: "sas:image:id", Value: imageID},
+			{Name: "sas:image:base", Value: container.BaseImage},
+		},
+	}
+
+	document.Components = []cdxComponent{}
+	for _, pkg := range packages {
+		component := cdxComponent{
+			Type:        "library",
+			Name:        pkg.Name,
+			Version:     pkg.FullVersion(),
+			Publisher:   pkg.Vendor,
+			Description: pkg.Summary,
+			PURL:        pkg.PackageURL(container.Platform.Name),
+		}
+		component.BOMRef = component.PURL
+		if pkg.SAS {
+			component.Publisher = "SAS Institute Inc."
+			component.Properties = append(component.Properties, cdxProperty{Name: "sas:package", Value: "true"})
+		}
+		if len(pkg.License) > 0 {
+			license := cdxLicense{}
+			license.License.Name = pkg.License
+			component.Licenses = []cdxLicense{license}
+		}
+		document.Components = append(document.Components, component)
+	}
+	return json.MarshalIndent(document, "", "  ")
+}
+
+// WriteSBOM collects the packages of the built image and writes its SPDX and CycloneDX documents
+// to the container's build directory. With --sbom-label the CycloneDX document is added to the image as a label.
+func (container *Container) WriteSBOM() error {
+	order := container.SoftwareOrder
+	inspect, _, err := container.DockerClient.ImageInspectWithRaw(order.BuildContext, container.GetWholeImageName())
+	if err != nil {
+		return err
+	}
+	packages, err := container.CollectPackages()
+	if err != nil {
+		return err
+	}
+	created := time.Now()
+
+	spdx, err := container.CreateSPDX(packages, inspect.ID, created)
+	if err != nil {
+		return err
+	}
+	cycloneDX, err := container.CreateCycloneDX(packages, inspect.ID, created)
+	if err != nil {
+		return err
+	}
+	for name, content := range map[string][]byte{SPDXFileName: spdx, CycloneDXFileName: cycloneDX} {
+		if err := ioutil.WriteFile(filepath.Join(container.BuildPath, name), append(content, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	sasPackages := 0
+	for _, pkg := range packages {
+		if pkg.SAS {
+			sasPackages++
+		}
+	}
+	container.SBOMPackages = len(packages)
+	container.WriteLog(fmt.Sprintf("Wrote the SBOM of the image to %s and %s: %d packages, %d from SAS",
+		filepath.Join(container.BuildPath, SPDXFileName), filepath.Join(container.BuildPath, CycloneDXFileName),
+		len(packages), sasPackages))
+
+	if order.SBOMLabel {
+		return container.AddSBOMLabel(cycloneDX)
+	}
+	return nil
+}
+
+// AddSBOMLabel adds the CycloneDX document to the image as a label, so it is pushed with the image.
+// The image is built again from itself with only the labels, which does not add a layer.
+func (container *Container) AddSBOMLabel(cycloneDX []byte) error {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(cycloneDX); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	// The Docker context only has a Dockerfile that starts from the built image
+	dockerfile := []byte("FROM " + container.GetWholeImageName() + "\n")
+	var buildContext bytes.Buffer
+	contextWriter := tar.NewWriter(&buildContext)
+	if err := contextWriter.WriteHeader(&tar.Header{Name: "Dockerfile", Size: int64(len(dockerfile)), Mode: 0644, ModTime: time.Now()}); err != nil {
+		return err
+	}
+	if _, err := contextWriter.Write(dockerfile); err != nil {
+		return err
+	}
+	if err := contextWriter.Close(); err != nil {
+		return err
+	}
+
+	buildOptions := types.ImageBuildOptions{
+		Context:     &buildContext,
+		Tags:        []string{container.GetWholeImageName()},
+		Dockerfile:  "Dockerfile",
+		Remove:      true,
+		ForceRemove: true,
+		Labels: map[string]string{
+			SBOMLabel:         base64.StdEncoding.EncodeToString(compressed.Bytes()),
+			SBOMFormatLabel:   "CycloneDX-1.4",
+			SBOMChecksumLabel: sha256Digest(cycloneDX),
+			SBOMEncodingLabel: "gzip+base64",
+		},
+	}
+	container.WriteLog("----- Adding the SBOM label -----")
+	if err := container.buildImage(buildOptions, nil); err != nil {
+		return err
+	}
+	container.WriteLog(fmt.Sprintf("Added the SBOM to the %s label: %d bytes", SBOMLabel, compressed.Len()))
+	return nil
+}
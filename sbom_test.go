@@ -0,0 +1,65 @@
+// sbom_test.go
+// Tests the package list that the SBOM of each image is created from.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The lines of sbomInventoryScript are parsed into sorted packages without duplicates
+func TestParseSBOMInventory(t *testing.T) {
+	tests := map[string]struct {
+		content  string
+		expected []SBOMPackage
+	}{
+		"rpm": {
+			content: "rpm\tbash\t(none)\t4.2.46\t34.el7\tx86_64\tGPLv3+\tCentOS\tThe GNU Bourne Again shell\n",
+			expected: []SBOMPackage{{Type: "rpm", Name: "bash", Version: "4.2.46", Release: "34.el7", Arch: "x86_64",
+				License: "GPLv3+", Vendor: "CentOS", Summary: "The GNU Bourne Again shell"}},
+		},
+		"sas rpm": {
+			content: "rpm\tsas-envesntl\t(none)\t3.4.0\t20190611\tx86_64\t(none)\tSAS Institute Inc.\tSAS Environment\r\n",
+			expected: []SBOMPackage{{Type: "rpm", Name: "sas-envesntl", Version: "3.4.0", Release: "20190611", Arch: "x86_64",
+				Vendor: "SAS Institute Inc.", Summary: "SAS Environment", SAS: true}},
+		},
+		"python from more than one pip": {
+			content:  "python\trequests==2.22.0\npython\tRequests==2.22.0\npython\tsix==1.12.0\n",
+			expected: []SBOMPackage{{Type: "python", Name: "requests", Version: "2.22.0"}, {Type: "python", Name: "six", Version: "1.12.0"}},
+		},
+		"sorted by type and name": {
+			content: "python\tsix==1.12.0\nrpm\tzlib\t(none)\t1.2.7\t18.el7\tx86_64\tzlib\tCentOS\tzlib\nrpm\tacl\t(none)\t2.2.51\t14.el7\tx86_64\tGPLv2+\tCentOS\tacl\n",
+			expected: []SBOMPackage{
+				{Type: "python", Name: "six", Version: "1.12.0"},
+				{Type: "rpm", Name: "acl", Version: "2.2.51", Release: "14.el7", Arch: "x86_64", License: "GPLv2+", Vendor: "CentOS", Summary: "acl"},
+				{Type: "rpm", Name: "zlib", Version: "1.2.7", Release: "18.el7", Arch: "x86_64", License: "zlib", Vendor: "CentOS", Summary: "zlib"},
+			},
+		},
+		"skipped lines": {
+			content:  "\npython\t-e git+https://example.com/repo.git#egg=tool\npython\t# comment\nrpm\ttoo\tfew\tfields\nunknown\tline\n",
+			expected: []SBOMPackage{},
+		},
+	}
+	for name, test := range tests {
+		packages := parseSBOMInventory(test.content)
+		if !reflect.DeepEqual(packages, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", name, test.expected, packages)
+		}
+	}
+}
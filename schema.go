@@ -0,0 +1,353 @@
+// schema.go
+// Validates the generated Kubernetes manifests without access to a cluster:
+// every object is checked against the bundled OpenAPI definitions of a
+// Kubernetes version, and every ConfigMap, Secret, Service, ServiceAccount, and
+// Role that an object refers to must be part of the generated manifests.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// KubernetesSchemasPath holds the bundled OpenAPI definitions and the Kubernetes versions that serve them
+const KubernetesSchemasPath = "util/kubernetes-schemas/"
+
+// DefaultKubernetesVersion is the Kubernetes version the manifests are validated against
+const DefaultKubernetesVersion = "1.13"
+
+// Matches the major and minor numbers of a version such as v1.13.4
+var kubernetesVersionRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+// SchemaDefinition is the subset of an OpenAPI schema that is used by the Kubernetes definitions
+type SchemaDefinition struct {
+	Type                 string                       `yaml:"type"`
+	Format               string                       `yaml:"format"`
+	Ref                  string                       `yaml:"$ref"`
+	Enum                 []string                     `yaml:"enum"`
+	Required             []string                     `yaml:"required"`
+	Properties           map[string]*SchemaDefinition `yaml:"properties"`
+	Items                *SchemaDefinition            `yaml:"items"`
+	AdditionalProperties *SchemaDefinition            `yaml:"additionalProperties"`
+	GroupVersionKind     []struct {
+		Group   string `yaml:"group"`
+		Version string `yaml:"version"`
+		Kind    string `yaml:"kind"`
+	} `yaml:"x-kubernetes-group-version-kind"`
+}
+
+// KubernetesSchemas are the definitions of the kinds that a single Kubernetes version serves
+type KubernetesSchemas struct {
+	Version     string
+	Definitions map[string]*SchemaDefinition
+	Served      map[string]*SchemaDefinition // Keyed by <apiVersion>/<kind>
+}
+
+// LoadKubernetesSchemas reads the bundled definitions for a Kubernetes version such as 1.13 or v1.13.4
+func LoadKubernetesSchemas(version string) (*KubernetesSchemas, error) {
+	match := kubernetesVersionRegex.FindStringSubmatch(strings.TrimSpace(version))
+	if match == nil {
+		return nil, fmt.Errorf("invalid Kubernetes version '%s': use the <major>.<minor> format, such as %s", version, DefaultKubernetesVersion)
+	}
+	schemas := &KubernetesSchemas{Version: match[1] + "." + match[2]}
+
+	versionsContent, err := ioutil.ReadFile(KubernetesSchemasPath + "versions.yml")
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]map[string][]string)
+	if err := yaml.Unmarshal(versionsContent, &versions); err != nil {
+		return nil, fmt.Errorf("Unable to parse %sversions.yml: %s", KubernetesSchemasPath, err.Error())
+	}
+	apiVersions, found := versions[schemas.Version]
+	if !found {
+		available := []string{}
+		for name := range versions {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		return nil, fmt.Errorf("no schemas are bundled for Kubernetes %s: choose between %s", schemas.Version, strings.Join(available, ", "))
+	}
+
+	definitionsContent, err := ioutil.ReadFile(KubernetesSchemasPath + "definitions.yml")
+	if err != nil {
+		return nil, err
+	}
+	definitions := struct {
+		Definitions map[string]*SchemaDefinition `yaml:"definitions"`
+	}{}
+	if err := yaml.Unmarshal(definitionsContent, &definitions); err != nil {
+		return nil, fmt.Errorf("Unable to parse %sdefinitions.yml: %s", KubernetesSchemasPath, err.Error())
+	}
+	schemas.Definitions = definitions.Definitions
+
+	// Only the kinds that the Kubernetes version serves can be used
+	schemas.Served = make(map[string]*SchemaDefinition)
+	for _, definition := range schemas.Definitions {
+		for _, gvk := range definition.GroupVersionKind {
+			apiVersion := gvk.Version
+			if len(gvk.Group) > 0 {
+				apiVersion = gvk.Group + "/" + gvk.Version
+			}
+			if stringInSlice(gvk.Kind, apiVersions[apiVersion]) {
+				schemas.Served[apiVersion+"/"+gvk.Kind] = definition
+			}
+		}
+	}
+	return schemas, nil
+}
+
+// yamlTypeName describes a parsed YAML value with the OpenAPI type names
+func yamlTypeName(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[interface{}]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// joinFieldPath adds a field name to a path such as spec.template
+func joinFieldPath(path string, field string) string {
+	if len(path) == 0 {
+		return field
+	}
+	return path + "." + field
+}
+
+// Validate checks a value against a schema and returns a "<field path>: <problem>" for each problem found
+func (schemas *KubernetesSchemas) Validate(schema *SchemaDefinition, value interface{}, path string) []string {
+	if len(schema.Ref) > 0 {
+		name := strings.TrimPrefix(schema.Ref, "#/definitions/")
+		definition, found := schemas.Definitions[name]
+		if !found {
+			return []string{fmt.Sprintf("%s: the schema refers to the unknown definition %s", path, name)}
+		}
+		schema = definition
+	}
+
+	// A null value is the same as a field that is not set
+	if value == nil {
+		return nil
+	}
+
+	problems := []string{}
+	valueType := yamlTypeName(value)
+	switch schema.Type {
+	case "object":
+		mapping, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an object but found %s %v", path, valueType, value)}
+		}
+		for _, field := range schema.Required {
+			if mapping[field] == nil {
+				problems = append(problems, fmt.Sprintf("%s: missing the required field", joinFieldPath(path, field)))
+			}
+		}
+		keys := []interface{}{}
+		for key := range mapping {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprintf("%v", keys[i]) < fmt.Sprintf("%v", keys[j]) })
+		for _, key := range keys {
+			field, item := fmt.Sprintf("%v", key), mapping[key]
+			if schema.Properties != nil {
+				property, found := schema.Properties[field]
+				if !found {
+					problems = append(problems, fmt.Sprintf("%s: unknown field", joinFieldPath(path, field)))
+					continue
+				}
+				problems = append(problems, schemas.Validate(property, item, joinFieldPath(path, field))...)
+			} else if schema.AdditionalProperties != nil {
+				problems = append(problems, schemas.Validate(schema.AdditionalProperties, item, joinFieldPath(path, field))...)
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an array but found %s %v", path, valueType, value)}
+		}
+		if schema.Items != nil {
+			for index, item := range list {
+				problems = append(problems, schemas.Validate(schema.Items, item, path+fieldPathElement(index, item))...)
+			}
+		}
+	case "string":
+		switch {
+		case schema.Format == "int-or-string" && (valueType == "string" || valueType == "integer"):
+		case schema.Format == "quantity" && (valueType == "string" || valueType == "integer" || valueType == "number"):
+		case valueType != "string":
+			return []string{fmt.Sprintf("%s: expected a string but found %s %v, quote the value", path, valueType, value)}
+		case schema.Format == "byte":
+			if _, err := base64.StdEncoding.DecodeString(value.(string)); err != nil {
+				return []string{fmt.Sprintf("%s: the value is not base64 encoded", path)}
+			}
+		}
+		if len(schema.Enum) > 0 && !stringInSlice(fmt.Sprintf("%v", value), schema.Enum) {
+			problems = append(problems, fmt.Sprintf("%s: '%v' is not one of %s", path, value, strings.Join(schema.Enum, ", ")))
+		}
+	case "integer":
+		if valueType != "integer" {
+			return []string{fmt.Sprintf("%s: expected an integer but found %s %v", path, valueType, value)}
+		}
+	case "number":
+		if valueType != "integer" && valueType != "number" {
+			return []string{fmt.Sprintf("%s: expected a number but found %s %v", path, valueType, value)}
+		}
+	case "boolean":
+		if valueType != "boolean" {
+			return []string{fmt.Sprintf("%s: expected a boolean but found %s %v", path, valueType, value)}
+		}
+	}
+	return problems
+}
+
+// ManifestReference is an object that another object refers to by name
+type ManifestReference struct {
+	Kind string
+	Name string
+	Path string
+}
+
+// FindReferences returns the objects in the same namespace that an object refers to.
+// References that are marked as optional are skipped.
+func FindReferences(object ManifestObject) []ManifestReference {
+	references := []ManifestReference{}
+	var walk func(path string, value interface{})
+	walk = func(path string, value interface{}) {
+		switch typed := value.(type) {
+		case []interface{}:
+			for index, item := range typed {
+				walk(path+fieldPathElement(index, item), item)
+			}
+		case map[interface{}]interface{}:
+			for key, item := range typed {
+				field := fmt.Sprintf("%v", key)
+				fieldPath := joinFieldPath(path, field)
+				mapping, _ := item.(map[interface{}]interface{})
+				optional := mapping != nil && mapping["optional"] == true
+
+				switch {
+				case (field == "configMapKeyRef" || field == "configMapRef" || field == "configMap") && mapping != nil && !optional:
+					references = append(references, ManifestReference{"ConfigMap", fmt.Sprintf("%v", mapping["name"]), fieldPath + ".name"})
+				case (field == "secretKeyRef" || field == "secretRef") && mapping != nil && !optional:
+					references = append(references, ManifestReference{"Secret", fmt.Sprintf("%v", mapping["name"]), fieldPath + ".name"})
+				case field == "secret" && mapping != nil && !optional:
+					references = append(references, ManifestReference{"Secret", fmt.Sprintf("%v", mapping["secretName"]), fieldPath + ".secretName"})
+				case field == "serviceAccountName" && item != "default":
+					references = append(references, ManifestReference{"ServiceAccount", fmt.Sprintf("%v", item), fieldPath})
+				case field == "backend" && mapping != nil:
+					references = append(references, ManifestReference{"Service", fmt.Sprintf("%v", mapping["serviceName"]), fieldPath + ".serviceName"})
+				case field == "roleRef" && mapping != nil:
+					references = append(references, ManifestReference{fmt.Sprintf("%v", mapping["kind"]), fmt.Sprintf("%v", mapping["name"]), fieldPath + ".name"})
+				case fieldPath == "spec.serviceName" && object.Kind == "StatefulSet":
+					references = append(references, ManifestReference{"Service", fmt.Sprintf("%v", item), fieldPath})
+				case field == "secretName" && strings.HasPrefix(path, "spec.tls["):
+					references = append(references, ManifestReference{"Secret", fmt.Sprintf("%v", item), fieldPath})
+				}
+				walk(fieldPath, item)
+			}
+		}
+	}
+	walk("", object.Object)
+	return references
+}
+
+// ValidateManifestObjects checks each object against the schemas and checks that the
+// objects it refers to are part of the same set. It returns every problem found.
+func (schemas *KubernetesSchemas) ValidateManifestObjects(objects []ManifestObject) []string {
+	problems := []string{}
+	ids := make(map[string]string)
+	for _, object := range objects {
+		if previousFile, found := ids[object.ID()]; found {
+			problems = append(problems, fmt.Sprintf("%s: %s: the object is also defined in %s", object.File, object.ID(), previousFile))
+		}
+		ids[object.ID()] = object.File
+	}
+
+	for _, object := range objects {
+		prefix := fmt.Sprintf("%s: %s/%s", object.File, object.Kind, object.Name)
+		if object.Object["apiVersion"] == nil || object.Object["kind"] == nil {
+			problems = append(problems, prefix+": missing the apiVersion or kind field")
+			continue
+		}
+		if len(object.Name) == 0 || object.Name == "<nil>" {
+			problems = append(problems, prefix+": metadata.name: missing the required field")
+		}
+		schema, found := schemas.Served[object.APIVersion+"/"+object.Kind]
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %s %s is not served by Kubernetes %s", prefix, object.APIVersion, object.Kind, schemas.Version))
+			continue
+		}
+		for _, problem := range schemas.Validate(schema, object.Object, "") {
+			problems = append(problems, prefix+": "+problem)
+		}
+		for _, reference := range FindReferences(object) {
+			if _, found := ids[reference.Kind+"/"+reference.Name]; !found {
+				problems = append(problems, fmt.Sprintf("%s: %s: refers to the %s %s which is not in the generated manifests",
+					prefix, reference.Path, reference.Kind, reference.Name))
+			}
+		}
+	}
+	return problems
+}
+
+// ValidateManifests checks the generated Kubernetes manifests against the schemas of the --kubernetes-version
+func (order *SoftwareOrder) ValidateManifests() error {
+	order.WriteLog(true, fmt.Sprintf("Validating the Kubernetes manifests against Kubernetes %s ...", order.KubernetesVersion))
+	inputs, err := order.LoadManifestInputs()
+	if err != nil {
+		return err
+	}
+	schemas, err := LoadKubernetesSchemas(order.KubernetesVersion)
+	if err != nil {
+		return err
+	}
+	manifestPath := inputs.ManifestPath() + "kubernetes/"
+	objects, err := loadManifestDocuments(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	problems := schemas.ValidateManifestObjects(objects)
+	if len(problems) > 0 {
+		result := fmt.Sprintf("%d problems were found in the Kubernetes manifests in %s\n  %s\n",
+			len(problems), manifestPath, strings.Join(problems, "\n  "))
+		result += "To skip this check use the --skip-manifest-validation argument.\n"
+		return errors.New(result)
+	}
+	order.WriteLog(true, fmt.Sprintf("Validated %d Kubernetes objects", len(objects)))
+	return nil
+}
@@ -0,0 +1,299 @@
+// templates.go
+// Renders the Dockerfile of each image of the multiple and full deployment
+// types from the text/template files in util/dockerfile-templates/. A file
+// with the same name in the --dockerfile-templates directory replaces the
+// default, such as a setup.tmpl that adds a corporate proxy or internal CA.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DockerfileTemplatesPath is the directory of the default Dockerfile templates
+const DockerfileTemplatesPath = "util/dockerfile-templates/"
+
+// DockerfileTemplateName is the template that includes the others to create a Dockerfile
+const DockerfileTemplateName = "Dockerfile.tmpl"
+
+// StripTemplateName is the template that adds the final stage of the --strip-build-tools argument
+const StripTemplateName = "strip.tmpl"
+
+// The instructions that only change the settings of an image. They are declared again in the final stage
+// of --strip-build-tools, since COPY --from only copies the files of the build stage.
+// The ARG instructions are not, since strip.tmpl declares the build arguments itself.
+var dockerfileSettingCommands = []string{
+	"CMD", "ENTRYPOINT", "ENV", "EXPOSE", "HEALTHCHECK", "LABEL", "ONBUILD", "SHELL", "STOPSIGNAL", "USER", "VOLUME", "WORKDIR",
+}
+
+// The settings that only keep their last value, so the final stage only declares the last one
+var dockerfileLastSettingCommands = []string{"CMD", "ENTRYPOINT", "HEALTHCHECK", "SHELL", "STOPSIGNAL", "USER"}
+
+// The paths that the final stage of --strip-build-tools copies from the build stage.
+// The packages that the roles install are spread across /etc, /usr, and /var, and SAS Viya is installed in /opt/sas.
+var strippedPaths = []string{"/etc", "/home", "/opt", "/usr", "/var"}
+
+// The directories that a role creates outside of strippedPaths
+var roleStrippedPaths = map[string][]string{
+	"consul": {"/anchors", "/consul", "/tokens"},
+}
+
+// DockerfileRole is an Ansible role that is run in its own RUN layer
+type DockerfileRole struct {
+	Name    string // The role name, such as consul
+	Dynamic bool   // The role is the container's own role and is added from the dynamicRoles directory
+}
+
+// DockerfileLabel is a LABEL of the image
+type DockerfileLabel struct {
+	Name  string
+	Value string
+}
+
+// DockerfileData is the data that the Dockerfile templates are executed with
+type DockerfileData struct {
+	Name           string             // The container name without the project name, such as httpproxy
+	ImageName      string             // The container name with the project name, such as sas-viya-httpproxy
+	BaseImage      string             // The --base-image argument or the base_image of the container's config
+	Platform       PlatformDefinition // The platform that was detected in the base image, such as .Platform.Name and .Platform.PackageManager
+	DeploymentType string             // The --type argument
+	ProjectName    string             // The --project-name argument
+	RecipeVersion  string             // The version of this project
+	BuildArgs      []string           // The names of the --build-arg arguments and the build_args of the container's config
+	Repositories   []string           // The .repo files of the --repositories directory, which are in the repositories/ directory of the context
+	Roles          []DockerfileRole   // The Ansible roles of the container in the order they are run
+	Volumes        []string           // The volumes from the config-<deployment-type>.yml
+	Ports          []string           // The ports from the config-<deployment-type>.yml
+	Addons         string             // The Dockerfile lines that the addons add to the image
+	Labels         []DockerfileLabel  // The labels that identify the image, in order
+
+	Healthcheck *ContainerHealthcheck // The healthcheck of the container's config, or nil
+	User        string                // The user of the container's config that runs the services
+	Entrypoint  []string              // The entrypoint of the container's config, which replaces tini
+	Cmd         []string              // The cmd of the container's config
+
+	StripBuildTools   bool     // The --strip-build-tools argument: the image is copied from a build stage without Ansible
+	StripPaths        []string // The paths that strip.tmpl copies from the build stage onto the base image
+	FinalInstructions []string // The settings of the build stage, which strip.tmpl declares again
+}
+
+// The functions that the templates can use besides the text/template builtins
+var dockerfileFuncs = template.FuncMap{
+	// json writes the JSON form of an instruction, such as ENTRYPOINT {{ json .Entrypoint }}
+	"json": func(values []string) (string, error) {
+		var content bytes.Buffer
+		encoder := json.NewEncoder(&content)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(values)
+		return strings.TrimSpace(content.String()), err
+	},
+}
+
+// LoadDockerfileTemplates parses the default Dockerfile templates, then replaces each one
+// with the file of the same name in the override directory.
+// The templates are executed once with sample data so errors are found before the build starts.
+func LoadDockerfileTemplates(overridePath string) (*template.Template, error) {
+	defaults, err := filepath.Glob(DockerfileTemplatesPath + "*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	if len(defaults) == 0 {
+		return nil, fmt.Errorf("No Dockerfile templates were found in %s", DockerfileTemplatesPath)
+	}
+	templates, err := template.New(DockerfileTemplateName).Option("missingkey=error").Funcs(dockerfileFuncs).ParseFiles(defaults...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the Dockerfile templates, %s", err.Error())
+	}
+
+	if len(overridePath) > 0 {
+		overrides, err := filepath.Glob(strings.TrimSuffix(overridePath, "/") + "/*.tmpl")
+		if err != nil {
+			return nil, err
+		}
+		if len(overrides) == 0 {
+			return nil, fmt.Errorf("No *.tmpl files were found in the --dockerfile-templates directory %s", overridePath)
+		}
+		names := []string{}
+		for _, path := range defaults {
+			names = append(names, filepath.Base(path))
+		}
+		sort.Strings(names)
+		for _, override := range overrides {
+			if !stringInSlice(filepath.Base(override), names) {
+				return nil, fmt.Errorf("The Dockerfile template %s does not replace a default template: choose between %s",
+					override, strings.Join(names, ", "))
+			}
+		}
+		if templates, err = templates.ParseFiles(overrides...); err != nil {
+			return nil, fmt.Errorf("Unable to parse the --dockerfile-templates, %s", err.Error())
+		}
+	}
+
+	sample := DockerfileData{
+		Name:           "consul",
+		ImageName:      "sas-viya-consul",
+		BaseImage:      "centos:7",
+		Platform:       supportedPlatforms[0],
+		DeploymentType: "multiple",
+		ProjectName:    "sas-viya",
+		RecipeVersion:  RecipeVersion,
+		BuildArgs:      []string{"JAVA_OPTIONS"},
+		Repositories:   []string{"internal.repo"},
+		Roles:          []DockerfileRole{{Name: "consul", Dynamic: true}},
+		Volumes:        []string{"/data"},
+		Ports:          []string{"8500"},
+		Labels:         []DockerfileLabel{{Name: "sas.recipe", Value: "true"}},
+
+		Healthcheck: &ContainerHealthcheck{Command: "curl --fail http://localhost:8500/v1/status/leader", Interval: 30, Timeout: 30, Retries: 3},
+		User:        "1001:1001",
+		Cmd:         []string{"--verbose"},
+
+		StripBuildTools: true,
+	}
+	if _, err := RenderDockerfile(templates, sample); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// RenderDockerfile executes the Dockerfile templates with an image's data.
+// With --strip-build-tools the final stage of strip.tmpl is added after the build stage.
+func RenderDockerfile(templates *template.Template, data DockerfileData) (string, error) {
+	var dockerfile bytes.Buffer
+	if err := templates.ExecuteTemplate(&dockerfile, DockerfileTemplateName, data); err != nil {
+		return "", fmt.Errorf("Unable to render the Dockerfile templates, %s", err.Error())
+	}
+	if !data.StripBuildTools {
+		return dockerfile.String(), nil
+	}
+
+	finalInstructions, err := finalStageInstructions(dockerfile.String())
+	if err != nil {
+		return "", err
+	}
+	data.FinalInstructions = finalInstructions
+	data.StripPaths = append([]string{}, strippedPaths...)
+	for _, role := range data.Roles {
+		data.StripPaths = append(data.StripPaths, roleStrippedPaths[role.Name]...)
+	}
+	addedPaths, err := buildStagePaths(dockerfile.String(), data.StripPaths)
+	if err != nil {
+		return "", err
+	}
+	data.StripPaths = append(data.StripPaths, addedPaths...)
+	if err := templates.ExecuteTemplate(&dockerfile, StripTemplateName, data); err != nil {
+		return "", fmt.Errorf("Unable to render the Dockerfile templates, %s", err.Error())
+	}
+	return dockerfile.String(), nil
+}
+
+// buildStagePaths returns the top-level directory of each COPY and ADD destination and WORKDIR of the last
+// stage of a Dockerfile that is not one of the paths that are already copied, so the final stage of
+// --strip-build-tools keeps the files that the addons add, such as /tmp/oracle_sasserver.sh and /hadoop/jars.
+// The top-level directory is copied since a RUN instruction can remove the destination after it is used.
+func buildStagePaths(content string, copiedPaths []string) ([]string, error) {
+	dockerfile, err := ParseDockerfile(content)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the rendered Dockerfile for --strip-build-tools, %s", err.Error())
+	}
+	// A relative path before the first WORKDIR is in the default WORKDIR of the base image, /
+	paths := []string{}
+	workdir := "/"
+	for _, instruction := range dockerfile.Instructions {
+		destination := ""
+		switch instruction.Command {
+		case "FROM":
+			paths = []string{}
+			workdir = "/"
+			continue
+		case "WORKDIR":
+			destination = instruction.Value
+		case "ADD", "COPY":
+			arguments := instruction.JSON
+			if !instruction.IsJSON {
+				arguments = strings.Fields(instruction.Value)
+			}
+			if len(arguments) < 2 {
+				continue
+			}
+			destination = arguments[len(arguments)-1]
+		default:
+			continue
+		}
+		if !path.IsAbs(destination) {
+			destination = path.Join(workdir, destination)
+		}
+		destination = path.Clean(destination)
+		if instruction.Command == "WORKDIR" {
+			workdir = destination
+			if destination == "/" {
+				continue
+			}
+		} else if destination == "/" {
+			return nil, fmt.Errorf("--strip-build-tools cannot keep the files that '%s' adds to /: add them to a directory instead",
+				strings.TrimSpace(instruction.Original))
+		}
+		topLevel := "/" + strings.SplitN(strings.TrimPrefix(destination, "/"), "/", 2)[0]
+		if !stringInSlice(topLevel, copiedPaths) && !stringInSlice(topLevel, paths) {
+			paths = append(paths, topLevel)
+		}
+	}
+	return paths, nil
+}
+
+// finalStageInstructions returns each instruction of the last stage of a Dockerfile that only changes
+// the settings of the image, such as ENV, LABEL, and ENTRYPOINT. The settings of the base image are kept
+// by the FROM of the final stage. A setting such as USER is only returned for its last value.
+func finalStageInstructions(content string) ([]string, error) {
+	dockerfile, err := ParseDockerfile(content)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the rendered Dockerfile for --strip-build-tools, %s", err.Error())
+	}
+	stage := []DockerfileInstruction{}
+	for _, instruction := range dockerfile.Instructions {
+		if instruction.Command == "FROM" {
+			stage = []DockerfileInstruction{}
+			continue
+		}
+		if !stringInSlice(instruction.Command, dockerfileSettingCommands) {
+			continue
+		}
+		if stringInSlice(instruction.Command, dockerfileLastSettingCommands) {
+			kept := []DockerfileInstruction{}
+			for _, previous := range stage {
+				if previous.Command != instruction.Command {
+					kept = append(kept, previous)
+				}
+			}
+			stage = kept
+		}
+		stage = append(stage, instruction)
+	}
+	instructions := []string{}
+	for _, instruction := range stage {
+		instructions = append(instructions, instruction.Original)
+	}
+	return instructions, nil
+}
@@ -0,0 +1,137 @@
+// templates_test.go
+// Tests the final stage that the Dockerfile templates add for --strip-build-tools.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The files that an addon adds outside of the stripped paths are copied into the final stage
+func TestRenderDockerfileStripKeepsAddonFiles(t *testing.T) {
+	templates, err := LoadDockerfileTemplates("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	data := DockerfileData{
+		Name:            "programming",
+		ImageName:       "sas-viya-programming",
+		BaseImage:       "centos:7",
+		Platform:        supportedPlatforms[0],
+		DeploymentType:  "multiple",
+		ProjectName:     "sas-viya",
+		RecipeVersion:   RecipeVersion,
+		Roles:           []DockerfileRole{{Name: "programming", Dynamic: true}},
+		Addons:          "# AddOn(s)\nCOPY oracle_sasserver.sh /tmp/\nCOPY hadoop/jars/ /hadoop/jars/\n",
+		StripBuildTools: true,
+	}
+	dockerfile, err := RenderDockerfile(templates, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	finalStage := dockerfile[strings.LastIndex(dockerfile, "\nFROM "):]
+	for _, path := range []string{"/opt", "/tmp", "/hadoop"} {
+		if !strings.Contains(finalStage, "\nCOPY --from=build "+path+" "+path+"\n") {
+			t.Errorf("expected the final stage to copy %s:\n%s", path, finalStage)
+		}
+	}
+}
+
+// Only the settings of the last stage are declared again, and a setting that keeps its last value only once
+func TestFinalStageInstructions(t *testing.T) {
+	tests := map[string]struct {
+		content  string
+		expected []string
+	}{
+		"settings": {
+			content:  "FROM centos:7\nENV A=1\nRUN echo\nLABEL a=b\nEXPOSE 80\nWORKDIR /opt\n",
+			expected: []string{"ENV A=1", "LABEL a=b", "EXPOSE 80", "WORKDIR /opt"},
+		},
+		"last value": {
+			content:  "FROM centos:7\nUSER sas\nENV A=1\nUSER root\nCMD [\"a\"]\nENTRYPOINT [\"tini\"]\nCMD [\"b\"]\nUSER sas\n",
+			expected: []string{"ENV A=1", "ENTRYPOINT [\"tini\"]", "CMD [\"b\"]", "USER sas"},
+		},
+		"last stage": {
+			content:  "FROM centos:7 AS base\nENV A=1\nUSER sas\nFROM base\nENV B=2\n",
+			expected: []string{"ENV B=2"},
+		},
+		"no ARG": {
+			content:  "FROM centos:7\nARG MODE\nCOPY a /a\n",
+			expected: []string{},
+		},
+		"continuation": {
+			content:  "FROM centos:7\nENV A=1 \\\n    B=2\n",
+			expected: []string{"ENV A=1 \\\n    B=2"},
+		},
+	}
+	for name, test := range tests {
+		instructions, err := finalStageInstructions(test.content)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(instructions, test.expected) {
+			t.Errorf("%s: expected %q, got %q", name, test.expected, instructions)
+		}
+	}
+}
+
+// Each top-level directory that the last stage adds files to is returned once
+func TestBuildStagePaths(t *testing.T) {
+	tests := map[string]struct {
+		content  string
+		expected []string
+	}{
+		"absolute destinations": {
+			content:  "FROM centos:7\nCOPY a.sh /tmp/\nCOPY b.sh /tmp/b/\nADD c.tgz /hadoop/c/\n",
+			expected: []string{"/tmp", "/hadoop"},
+		},
+		"relative to the workdir": {
+			content:  "FROM centos:7\nWORKDIR /data\nCOPY a.sh ./a.sh\nWORKDIR sub\nCOPY b.sh b.sh\n",
+			expected: []string{"/data"},
+		},
+		"json form": {
+			content:  "FROM centos:7\nCOPY [\"a b.sh\", \"/scripts/a b.sh\"]\n",
+			expected: []string{"/scripts"},
+		},
+		"already copied": {
+			content:  "FROM centos:7\nCOPY tnsnames.ora /etc/\nCOPY helper.sh /usr/local/bin/helper.sh\n",
+			expected: []string{},
+		},
+		"last stage only": {
+			content:  "FROM centos:7 AS build\nCOPY a.sh /tmp/\nFROM centos:7\nCOPY --from=build /srv /srv\n",
+			expected: []string{"/srv"},
+		},
+	}
+	for name, test := range tests {
+		paths, err := buildStagePaths(test.content, []string{"/etc", "/usr"})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%s: expected %v, got %v", name, test.expected, paths)
+		}
+	}
+
+	if _, err := buildStagePaths("FROM centos:7\nCOPY a.sh /\n", nil); err == nil {
+		t.Errorf("expected an error for a file that is added to /")
+	}
+}
@@ -0,0 +1,29 @@
+{{/*
+Helpers for the chart that is created by SAS Container Recipes.
+Each helper is called with a dict of the root context and one service's values:
+  (dict "root" $ "service" $service)
+*/}}
+
+{{/* Name of a service's Kubernetes objects: <projectName>-<service name> */}}
+{{- define "sas-viya.fullname" -}}
+{{- printf "%s-%s" .root.Values.projectName .service.name | lower -}}
+{{- end -}}
+
+{{/* Fully qualified image name, the service's tag replaces the global tag if it is set */}}
+{{- define "sas-viya.image" -}}
+{{- $tag := default .root.Values.image.tag .service.image.tag -}}
+{{- if and .root.Values.image.registry .root.Values.image.namespace -}}
+{{- printf "%s/%s/%s:%s" .root.Values.image.registry .root.Values.image.namespace .service.image.repository $tag -}}
+{{- else -}}
+{{- printf "%s:%s" .service.image.repository $tag -}}
+{{- end -}}
+{{- end -}}
+
+{{/* Labels that are added to every object of a service */}}
+{{- define "sas-viya.labels" -}}
+app: {{ include "sas-viya.fullname" . }}
+domain: {{ .root.Values.projectName }}
+app.kubernetes.io/managed-by: {{ .root.Release.Service }}
+app.kubernetes.io/instance: {{ .root.Release.Name }}
+helm.sh/chart: {{ printf "%s-%s" .root.Chart.Name .root.Chart.Version | replace "+" "_" }}
+{{- end -}}
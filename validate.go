@@ -0,0 +1,555 @@
+// validate.go
+// Strictly checks the config-<deployment-type>.yml, --config, and addon_config.yml
+// files so a misspelled key or a malformed port, resource, or volume is reported
+// with its file and line number instead of being silently ignored.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// yaml.v2 prefixes its decoding errors with the line number
+	yamlErrorLineRegex = regexp.MustCompile(`line (\d+): (.*)`)
+
+	// A "<container>:<host>" port mapping or a single port
+	portMappingRegex = regexp.MustCompile(`^(\d+)(:(\d+))?$`)
+
+	// A Kubernetes resource quantity such as 500m, 2, or 12000Mi
+	quantityRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([numkMGTPE]|[KMGTPE]i|[eE][0-9]+)?$`)
+
+	// A Kubernetes resource name such as memory, cpu, or nvidia.com/gpu
+	resourceNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9./]*[a-z0-9])?$`)
+
+	// An environment variable or secret name
+	variableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+	// A Kubernetes volume name
+	volumeNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	// A ConfigMap or Secret key such as sssd.conf
+	fileKeyRegex = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+	// A Docker label name such as com.mycompany.team
+	labelNameRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+
+	// A USER such as sas, 1001, or 1001:1001
+	userRegex = regexp.MustCompile(`^([a-z_][a-z0-9_-]*|[0-9]+)(:([a-z_][a-z0-9_-]*|[0-9]+))?$`)
+
+	// The hex encoded SHA-256 checksum of an addon artifact
+	sha256Regex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+// ConfigProblem is a mistake found in a config or addon file.
+// A warning is reported but does not stop the build.
+type ConfigProblem struct {
+	File    string
+	Line    int
+	Message string
+	Warning bool
+}
+
+func (problem ConfigProblem) String() string {
+	location := problem.File
+	if problem.Line > 0 {
+		location += ":" + strconv.Itoa(problem.Line)
+	}
+	if problem.Warning {
+		return location + ": warning: " + problem.Message
+	}
+	return location + ": " + problem.Message
+}
+
+// indexYAMLLines maps the path of each key and list item in a block style YAML file,
+// such as computeserver.resources.limits[0], to its line number.
+func indexYAMLLines(content []byte) map[string]int {
+	type level struct {
+		indent int
+		path   string
+		items  int
+	}
+	index := make(map[string]int)
+	stack := []level{{indent: -1}}
+	for number, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" || trimmed == "..." {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		// List items are often at the same indentation as their key so count them one deeper
+		isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		if isItem {
+			indent++
+		}
+		for len(stack) > 1 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		parent := &stack[len(stack)-1]
+		if isItem {
+			index[fmt.Sprintf("%s[%d]", parent.path, parent.items)] = number + 1
+			parent.items++
+			continue
+		}
+
+		key := strings.Trim(strings.TrimSpace(strings.SplitN(trimmed, ":", 2)[0]), `"'`)
+		path := key
+		if parent.path != "" {
+			path = parent.path + "." + key
+		}
+		index[path] = number + 1
+		stack = append(stack, level{indent: indent, path: path})
+	}
+	return index
+}
+
+// lineOf returns the line of a path from indexYAMLLines or of its nearest parent,
+// since the items of a flow style list such as [Dockerfile] are not indexed
+func lineOf(lines map[string]int, path string) int {
+	for len(path) > 0 {
+		if line, found := lines[path]; found {
+			return line
+		}
+		end := strings.LastIndexAny(path, ".[")
+		if end < 0 {
+			break
+		}
+		path = path[:end]
+	}
+	return 0
+}
+
+// decodeProblems converts the error of a strict YAML decode into one problem per line
+func decodeProblems(file string, err error) []ConfigProblem {
+	messages := []string{err.Error()}
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	}
+	problems := []ConfigProblem{}
+	for _, message := range messages {
+		problem := ConfigProblem{File: file, Message: strings.TrimPrefix(message, "yaml: ")}
+		if match := yamlErrorLineRegex.FindStringSubmatch(message); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// validateConfigItem checks the syntax of a single item of a container's config list
+func validateConfigItem(field string, item string) string {
+	switch field {
+	case "ports":
+		match := portMappingRegex.FindStringSubmatch(strings.TrimSpace(item))
+		if match == nil {
+			return fmt.Sprintf("invalid port mapping '%s': expected <container-port>:<host-port>", item)
+		}
+		for _, port := range []string{match[1], match[3]} {
+			if number, err := strconv.Atoi(port); port != "" && (err != nil || number < 1 || number > 65535) {
+				return fmt.Sprintf("invalid port mapping '%s': %s is not a port number", item, port)
+			}
+		}
+	case "environment", "secrets":
+		if !strings.Contains(item, "=") {
+			return fmt.Sprintf("invalid %s item '%s': expected NAME=value", field, item)
+		}
+		if name, _ := splitKeyValue(item, "="); !variableNameRegex.MatchString(name) {
+			return fmt.Sprintf("invalid %s item '%s': '%s' is not a valid variable name", field, item, name)
+		}
+	case "volumes":
+		name, path := splitKeyValue(item, "=")
+		if !strings.Contains(item, "=") {
+			return fmt.Sprintf("invalid volume '%s': expected <name>=<path>", item)
+		}
+		if !volumeNameRegex.MatchString(name) {
+			return fmt.Sprintf("invalid volume '%s': '%s' must contain only a-z, 0-9, or -", item, name)
+		}
+		if !strings.HasPrefix(strings.TrimSpace(path), "/") {
+			return fmt.Sprintf("invalid volume '%s': the path must be absolute", item)
+		}
+	case "resources.limits", "resources.requests":
+		name, quantity := splitKeyValue(item, "=")
+		if !strings.Contains(item, "=") {
+			return fmt.Sprintf("invalid resource '%s': expected <resource>=<quantity> such as memory=12000Mi", item)
+		}
+		if !resourceNameRegex.MatchString(name) {
+			return fmt.Sprintf("invalid resource '%s': '%s' is not a resource name", item, name)
+		}
+		if !quantityRegex.MatchString(strings.TrimSpace(quantity)) {
+			return fmt.Sprintf("invalid resource '%s': '%s' is not a quantity such as 500m, 2, or 12000Mi", item, quantity)
+		}
+	case "roles":
+		if strings.TrimSpace(item) == "" {
+			return "empty role name"
+		}
+	case "build_args":
+		name, _ := splitKeyValue(item, "=")
+		if !strings.Contains(item, "=") {
+			return fmt.Sprintf("invalid build argument '%s': expected NAME=value", item)
+		}
+		if !variableNameRegex.MatchString(name) {
+			return fmt.Sprintf("invalid build argument '%s': '%s' is not a valid variable name", item, name)
+		}
+		if stringInSlice(name, providedBuildArgs) {
+			return fmt.Sprintf("invalid build argument '%s': %s is set by the build", item, name)
+		}
+		if stringInSlice(name, proxyBuildArgs) {
+			return fmt.Sprintf("invalid build argument '%s': use the --http-proxy, --https-proxy, or --no-proxy arguments", item)
+		}
+	case "labels":
+		name, value := splitKeyValue(item, "=")
+		if !strings.Contains(item, "=") {
+			return fmt.Sprintf("invalid label '%s': expected name=value", item)
+		}
+		if !labelNameRegex.MatchString(name) {
+			return fmt.Sprintf("invalid label '%s': '%s' must contain only A-Z, a-z, 0-9, ., _, /, or -", item, name)
+		}
+		if strings.HasPrefix(name, "sas.recipe") || strings.HasPrefix(name, "sas.layer.") {
+			return fmt.Sprintf("invalid label '%s': the sas.recipe and sas.layer labels are set by the build", item)
+		}
+		if strings.ContainsAny(value, "\"\\\n") {
+			return fmt.Sprintf("invalid label '%s': the value cannot contain a quote, a backslash, or a new line", item)
+		}
+	}
+	return ""
+}
+
+// validateContainerRuntime checks the healthcheck, user, entrypoint, and cmd of a container's config
+func validateContainerRuntime(config ContainerConfig) map[string]string {
+	problems := make(map[string]string)
+	healthcheck := config.Healthcheck
+	if strings.Contains(healthcheck.Command, "\n") {
+		problems["healthcheck.command"] = "invalid healthcheck command: it must be a single line"
+	}
+	if len(healthcheck.Command) == 0 && healthcheck != (ContainerHealthcheck{}) {
+		problems["healthcheck"] = "invalid healthcheck: a command is required"
+	}
+	seconds := map[string]int{
+		"interval":     healthcheck.Interval,
+		"timeout":      healthcheck.Timeout,
+		"start_period": healthcheck.StartPeriod,
+		"retries":      healthcheck.Retries,
+	}
+	for field, value := range seconds {
+		if value < 0 {
+			problems["healthcheck."+field] = fmt.Sprintf("invalid healthcheck %s %d: it cannot be negative", field, value)
+		}
+	}
+	if len(config.User) > 0 && !userRegex.MatchString(config.User) {
+		problems["user"] = fmt.Sprintf("invalid user '%s': expected a name or a number, such as sas or 1001:1001", config.User)
+	}
+	for field, values := range map[string][]string{"entrypoint": config.Entrypoint, "cmd": config.Cmd} {
+		for index, value := range values {
+			if len(value) == 0 || strings.Contains(value, "\n") {
+				problems[fmt.Sprintf("%s[%d]", field, index)] = fmt.Sprintf("invalid %s item %d: it cannot be empty or contain a new line", field, index)
+			}
+		}
+	}
+	names := []string{}
+	for index, file := range config.Files {
+		field := fmt.Sprintf("files[%d]", index)
+		switch {
+		case !fileKeyRegex.MatchString(file.Name) || file.Name == "." || file.Name == "..":
+			problems[field] = fmt.Sprintf("invalid file name '%s': it must contain only a-z, A-Z, 0-9, -, _, or .", file.Name)
+		case stringInSlice(file.Name, names):
+			problems[field] = fmt.Sprintf("invalid file name '%s': it is listed more than once", file.Name)
+		case len(file.Source) == 0:
+			problems[field] = fmt.Sprintf("invalid file %s: a source is required", file.Name)
+		case !strings.HasPrefix(file.MountPath, "/"):
+			problems[field] = fmt.Sprintf("invalid file %s: the mount_path must be absolute", file.Name)
+		case file.Mode < 0 || file.Mode > 0777:
+			problems[field] = fmt.Sprintf("invalid file %s: the mode %#o is not between 0 and 0777", file.Name, file.Mode)
+		}
+		names = append(names, file.Name)
+	}
+	return problems
+}
+
+// validateContainerConfig checks the syntax of every list item of a container's config
+func validateContainerConfig(file string, lines map[string]int, name string, config ContainerConfig) []ConfigProblem {
+	fields := map[string][]string{
+		"ports":              config.Ports,
+		"environment":        config.Environment,
+		"secrets":            config.Secrets,
+		"roles":              config.Roles,
+		"volumes":            config.Volumes,
+		"resources.limits":   config.Resources.Limits,
+		"resources.requests": config.Resources.Requests,
+		"build_args":         config.BuildArgs,
+		"labels":             config.Labels,
+	}
+	problems := []ConfigProblem{}
+	for _, field := range configOverlayFields {
+		for index, item := range fields[field] {
+			if message := validateConfigItem(field, item); message != "" {
+				line := lineOf(lines, fmt.Sprintf("%s.%s[%d]", name, field, index))
+				problems = append(problems, ConfigProblem{File: file, Line: line, Message: name + ": " + message})
+			}
+		}
+	}
+	if strings.ContainsAny(config.BaseImage, " \t\n\"") {
+		line := lineOf(lines, name+".base_image")
+		problems = append(problems, ConfigProblem{File: file, Line: line, Message: fmt.Sprintf("%s: invalid base_image '%s'", name, config.BaseImage)})
+	}
+	runtimeProblems := validateContainerRuntime(config)
+	runtimeFields := []string{}
+	for field := range runtimeProblems {
+		runtimeFields = append(runtimeFields, field)
+	}
+	sort.Strings(runtimeFields)
+	for _, field := range runtimeFields {
+		line := lineOf(lines, name+"."+field)
+		problems = append(problems, ConfigProblem{File: file, Line: line, Message: name + ": " + runtimeProblems[field]})
+	}
+	return problems
+}
+
+// ValidateConfigFile strictly decodes a config-<deployment-type>.yml or --config file and checks
+// each container's items. If an inventory is given then the container names must be in the order:
+// an unknown name is an error in an overlay and a warning in the shipped file, which lists every container.
+func ValidateConfigFile(path string, overlay bool, inventory []string) []ConfigProblem {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []ConfigProblem{{File: path, Message: err.Error()}}
+	}
+	lines := indexYAMLLines(content)
+
+	// The decoding continues after a type error, such as an unknown field, so the rest of the file is still checked
+	configs := make(map[string]ConfigOverlay)
+	if overlay {
+		err = yaml.UnmarshalStrict(content, &configs)
+	} else {
+		shipped := make(map[string]ContainerConfig)
+		err = yaml.UnmarshalStrict(content, &shipped)
+		for name, config := range shipped {
+			configs[name] = ConfigOverlay{ContainerConfig: config}
+		}
+	}
+	problems := []ConfigProblem{}
+	if err != nil {
+		problems = decodeProblems(path, err)
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return problems
+		}
+	}
+
+	names := []string{}
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(inventory) > 0 && !stringInSlice(name, inventory) {
+			problems = append(problems, ConfigProblem{
+				File:    path,
+				Line:    lines[name],
+				Message: fmt.Sprintf("%s is not a container in the order: choose between %s", name, strings.Join(inventory, ", ")),
+				Warning: !overlay,
+			})
+		}
+		for index, field := range configs[name].Replace {
+			if !stringInSlice(field, configOverlayFields) {
+				problems = append(problems, ConfigProblem{
+					File:    path,
+					Line:    lineOf(lines, fmt.Sprintf("%s.replace[%d]", name, index)),
+					Message: fmt.Sprintf("%s: invalid replace field '%s': choose between %s", name, field, strings.Join(configOverlayFields, ", ")),
+				})
+			}
+		}
+		problems = append(problems, validateContainerConfig(path, lines, name, configs[name].ContainerConfig)...)
+	}
+	return problems
+}
+
+// ValidateAddonConfig strictly decodes an addon's addon_config.yml, checks the items it adds to the manifests,
+// and warns about listed Dockerfiles that do not exist
+func ValidateAddonConfig(addon string) []ConfigProblem {
+	path := addon + AddonConfigName
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []ConfigProblem{{File: path, Message: err.Error()}}
+	}
+	lines := indexYAMLLines(content)
+
+	// The current format places the images under "images", the original format has them at the top level
+	images := make(map[string]effectedImage)
+	manifests := make(map[string]AddonManifest)
+	artifacts := []AddonArtifact{}
+	lintIgnore := []string{}
+	prefix := ""
+	if isAddonConfigV2(content) {
+		manifest := Addon{}
+		err = yaml.UnmarshalStrict(content, &manifest)
+		images = manifest.Images
+		manifests = manifest.Manifests
+		artifacts = manifest.Artifacts
+		lintIgnore = manifest.LintIgnore
+		prefix = "images."
+	} else {
+		err = yaml.UnmarshalStrict(content, &images)
+	}
+	problems := []ConfigProblem{}
+	if err != nil {
+		problems = decodeProblems(path, err)
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return problems
+		}
+	}
+
+	names := []string{}
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(images[name].Dockerfiles) == 0 {
+			problems = append(problems, ConfigProblem{File: path, Line: lines[prefix+name], Message: name + ": no dockerfiles are listed"})
+		}
+		// A missing Dockerfile is skipped by appendAddonLines, which some addons rely on to only add their label
+		for _, dockerfile := range images[name].Dockerfiles {
+			if _, err := os.Stat(addon + dockerfile); err != nil {
+				problems = append(problems, ConfigProblem{
+					File:    path,
+					Line:    lineOf(lines, prefix+name+".dockerfiles"),
+					Message: fmt.Sprintf("%s: the dockerfile %s does not exist in %s", name, dockerfile, addon),
+					Warning: true,
+				})
+			}
+		}
+	}
+
+	names = []string{}
+	for name := range manifests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, validateContainerConfig(path, lines, "manifests."+name, manifests[name].overlay().ContainerConfig)...)
+	}
+
+	for index, rule := range lintIgnore {
+		if !stringInSlice(rule, LintRuleNames()) {
+			problems = append(problems, ConfigProblem{File: path, Line: lineOf(lines, fmt.Sprintf("lint_ignore[%d]", index)),
+				Message: fmt.Sprintf("lint_ignore: unknown lint rule '%s': choose between %s", rule, strings.Join(LintRuleNames(), ", "))})
+		}
+	}
+
+	for index, artifact := range artifacts {
+		line := lineOf(lines, fmt.Sprintf("artifacts[%d].path", index))
+		if len(artifact.Path) == 0 {
+			problems = append(problems, ConfigProblem{File: path, Line: line, Message: "artifacts: no path is given"})
+		}
+		if len(artifact.SHA256) == 0 {
+			continue
+		}
+		line = lineOf(lines, fmt.Sprintf("artifacts[%d].sha256", index))
+		if !sha256Regex.MatchString(artifact.SHA256) {
+			problems = append(problems, ConfigProblem{File: path, Line: line,
+				Message: fmt.Sprintf("artifacts: invalid sha256 '%s' for %s: expected 64 hexadecimal characters", artifact.SHA256, artifact.Path)})
+		}
+		if strings.ContainsAny(artifact.Path, "*?[") {
+			problems = append(problems, ConfigProblem{File: path, Line: line,
+				Message: fmt.Sprintf("artifacts: a sha256 cannot be checked for the pattern %s: give the file name instead", artifact.Path)})
+		}
+	}
+	return problems
+}
+
+// ValidateFiles checks the config, --config, and addon files of the order.
+// Each problem is logged and an error is returned if any of them is not a warning.
+func (order *SoftwareOrder) ValidateFiles(inventory []string) error {
+	problems := []ConfigProblem{}
+	if !order.Deployment.SingleContainer {
+		problems = append(problems, ValidateConfigFile(order.ConfigPath, false, inventory)...)
+		for _, overlayPath := range order.ConfigOverlays {
+			problems = append(problems, ValidateConfigFile(overlayPath, true, inventory)...)
+		}
+	}
+	for _, addon := range order.AddOns {
+		problems = append(problems, ValidateAddonConfig(addon)...)
+	}
+
+	errorCount := 0
+	report := []string{}
+	for _, problem := range problems {
+		if !problem.Warning {
+			errorCount++
+		}
+		report = append(report, problem.String())
+	}
+	if len(report) > 0 {
+		order.WriteLog(true, strings.Join(report, "\n"))
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("%d problem(s) were found in the config and addon files", errorCount)
+	}
+	return nil
+}
+
+// Validate is the validate command. It checks the config and addon files without building.
+// If a --zip is given then the playbook is generated so the container names can be checked against the order.
+// The playbook is generated in a temporary directory, so the builds/<deployment-type> link keeps pointing at the last build.
+func (order *SoftwareOrder) Validate() error {
+	inventory := []string{}
+	if len(order.SOEZipPath) > 0 {
+		buildPath, err := ioutil.TempDir("", "sas-container-recipes-validate-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(buildPath)
+		order.BuildPath = buildPath + "/"
+		done := make(chan int)
+		fail := make(chan string)
+		progress := make(chan string)
+		go order.LoadPlaybook(progress, fail, done)
+	wait:
+		for {
+			select {
+			case <-done:
+				break wait
+			case failure := <-fail:
+				return errors.New(failure)
+			case message := <-progress:
+				order.WriteLog(true, message)
+			}
+		}
+		for name := range order.Containers {
+			inventory = append(inventory, name)
+		}
+		sort.Strings(inventory)
+	}
+
+	if err := order.ValidateFiles(inventory); err != nil {
+		return err
+	}
+	order.WriteLog(true, "No problems were found in the config and addon files")
+	return nil
+}